@@ -0,0 +1,340 @@
+package fetch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator adds credentials to requests for a Pkg's meta file and parts.
+// Authenticators are configured per URL prefix in Options; they may be shared
+// among fetches and are called concurrently.
+type Authenticator interface {
+	// Authenticate adds credentials to the request; an error fails the
+	// request without it being sent
+	Authenticate(req *http.Request) error
+}
+
+// BasicAuth authenticates requests with a username and password
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authenticate implements Authenticator
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// BearerToken authenticates requests with a fixed bearer token
+type BearerToken struct {
+	Token string
+}
+
+// Authenticate implements Authenticator
+func (a *BearerToken) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// oauth2ExpiryDelta is how long before its expiry an OAuth2 token is
+// refreshed so that it doesn't expire in flight
+const oauth2ExpiryDelta = 10 * time.Second
+
+// OAuth2ClientCredentials authenticates requests with a bearer token obtained
+// from an OAuth2 token endpoint with the client credentials grant (RFC 6749,
+// section 4.4). The token is requested when first needed and again shortly
+// before it expires.
+type OAuth2ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// Client makes token requests; if nil, http.DefaultClient is used
+	Client *http.Client
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewOAuth2ClientCredentials returns an authenticator obtaining tokens for
+// the given client from the given token endpoint
+func NewOAuth2ClientCredentials(tokenURL string, clientID string, clientSecret string, scopes ...string) *OAuth2ClientCredentials {
+	return &OAuth2ClientCredentials{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+	}
+}
+
+// oauth2TokenResponse is the successful response of a token endpoint
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Authenticate implements Authenticator
+func (a *OAuth2ClientCredentials) Authenticate(req *http.Request) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.token == "" || (!a.expiry.IsZero() && time.Now().Add(oauth2ExpiryDelta).After(a.expiry)) {
+		if err := a.refresh(req); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// refresh requests a new token, canceled along with the given request
+func (a *OAuth2ClientCredentials) refresh(req *http.Request) error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+
+	tokenReq, err := http.NewRequest(http.MethodPost, a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	tokenReq = tokenReq.WithContext(req.Context())
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	glog.V(3).Infof("Requesting OAuth2 token for client %v from %v", a.ClientID, Redact(a.TokenURL))
+	response, err := client.Do(tokenReq)
+	if err != nil {
+		return fmt.Errorf("Unable to request OAuth2 token from %v. Error: %v", a.TokenURL, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to read OAuth2 token response from %v. Error: %v", a.TokenURL, err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected HTTP status code in OAuth2 token response from %v: %v", a.TokenURL, response.StatusCode)
+	}
+
+	var token oauth2TokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("Unable to parse OAuth2 token response from %v. Error: %v", a.TokenURL, err)
+	}
+
+	if token.AccessToken == "" {
+		return fmt.Errorf("OAuth2 token response from %v has no access token", a.TokenURL)
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return fmt.Errorf("Unsupported OAuth2 token type in response from %v: %v", a.TokenURL, token.TokenType)
+	}
+
+	a.token = token.AccessToken
+	a.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		a.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return nil
+}
+
+// netrcEntry is the login and password of a machine in a .netrc file
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// Netrc authenticates requests with Basic auth using the login and password
+// of the request's host from a .netrc file, or those of its default entry.
+// Requests to hosts without an entry are sent as they are.
+type Netrc struct {
+	machines map[string]netrcEntry
+	fallback *netrcEntry
+}
+
+// NewNetrc reads the .netrc file at the given path. If the path is empty,
+// the file named by the NETRC environment variable is read or, if that's
+// unset, $HOME/.netrc.
+func NewNetrc(path string) (*Netrc, error) {
+	if path == "" {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".netrc")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	netrc := &Netrc{machines: make(map[string]netrcEntry, 0)}
+
+	var current *netrcEntry
+	var machine string
+	// the next token is the value of this keyword
+	var keyword string
+	var inMacro bool
+
+	commit := func() {
+		if current == nil {
+			return
+		}
+		if machine == "" {
+			netrc.fallback = current
+		} else if _, exists := netrc.machines[machine]; !exists {
+			// like other readers, the first entry for a machine wins
+			netrc.machines[machine] = *current
+		}
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// macro definitions run to the next blank line
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+
+		for _, token := range strings.Fields(line) {
+			if keyword != "" {
+				switch keyword {
+				case "machine":
+					commit()
+					current = &netrcEntry{}
+					machine = token
+				case "login":
+					if current != nil {
+						current.login = token
+					}
+				case "password":
+					if current != nil {
+						current.password = token
+					}
+				case "macdef":
+					inMacro = true
+				}
+				keyword = ""
+				continue
+			}
+
+			switch token {
+			case "default":
+				commit()
+				current = &netrcEntry{}
+				machine = ""
+			case "machine", "login", "password", "account", "macdef":
+				keyword = token
+			}
+		}
+
+		if keyword == "macdef" {
+			// the name is optional
+			keyword = ""
+			inMacro = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read netrc file %v. Error: %v", path, err)
+	}
+	commit()
+
+	return netrc, nil
+}
+
+// Authenticate implements Authenticator
+func (n *Netrc) Authenticate(req *http.Request) error {
+	entry, exists := n.machines[req.URL.Hostname()]
+	if !exists {
+		if n.fallback == nil {
+			return nil
+		}
+		entry = *n.fallback
+	}
+
+	if entry.login != "" || entry.password != "" {
+		req.SetBasicAuth(entry.login, entry.password)
+	}
+	return nil
+}
+
+// prefixAuthenticator is an authenticator configured for the URLs starting
+// with the given prefix
+type prefixAuthenticator struct {
+	prefix        string
+	authenticator Authenticator
+}
+
+// authenticators are the authenticators of a fetch, longest prefix first
+type authenticators []prefixAuthenticator
+
+// newAuthenticators combines the Basic auth credentials of the given map,
+// keyed by URL prefix and holding "username" and "password", with the given
+// authenticators, which take precedence for the same prefix
+func newAuthenticators(authCreds map[string]map[string]string, configured map[string]Authenticator) authenticators {
+	byPrefix := make(map[string]Authenticator, 0)
+
+	for prefix, creds := range authCreds {
+		if creds["username"] != "" && creds["password"] != "" {
+			byPrefix[prefix] = &BasicAuth{creds["username"], creds["password"]}
+		}
+	}
+
+	for prefix, authenticator := range configured {
+		if authenticator != nil {
+			byPrefix[prefix] = authenticator
+		}
+	}
+
+	var auth authenticators
+	for prefix, authenticator := range byPrefix {
+		auth = append(auth, prefixAuthenticator{prefix, authenticator})
+	}
+
+	sort.Slice(auth, func(i, j int) bool {
+		if len(auth[i].prefix) != len(auth[j].prefix) {
+			return len(auth[i].prefix) > len(auth[j].prefix)
+		}
+		return auth[i].prefix < auth[j].prefix
+	})
+
+	return auth
+}
+
+// match returns the authenticator with the longest prefix of the given URL,
+// or nil if there's none
+func (a authenticators) match(pURL string) *prefixAuthenticator {
+	for ix := range a {
+		if strings.HasPrefix(pURL, a[ix].prefix) {
+			return &a[ix]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// +build unit
+
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func authorization(t *testing.T, auth authenticators, pURL string) string {
+	req, err := authenticatedRequest(context.Background(), pURL, auth)
+	assert.Nil(t, err)
+	return req.Header.Get("Authorization")
+}
+
+func Test_Authenticators_LongestPrefix(t *testing.T) {
+	authCreds := map[string]map[string]string{
+		"https://example.com/":          {"username": "site", "password": "pw"},
+		"https://example.com/pkgs/":     {"username": "pkgs", "password": "pw"},
+		"https://example.com/pkgs/one/": {"username": "incomplete"},
+	}
+	configured := map[string]Authenticator{
+		"https://example.com/pkgs/":       &BearerToken{"pkgs-token"},
+		"https://example.com/pkgs/other/": &BearerToken{"other-token"},
+	}
+
+	auth := newAuthenticators(authCreds, configured)
+
+	// for the same prefix a configured authenticator wins over the credentials
+	assert.EqualValues(t, "Bearer pkgs-token", authorization(t, auth, "https://example.com/pkgs/one/pkg.json"))
+	assert.EqualValues(t, "Bearer other-token", authorization(t, auth, "https://example.com/pkgs/other/pkg.json"))
+
+	req, err := authenticatedRequest(context.Background(), "https://example.com/elsewhere/pkg.json", auth)
+	assert.Nil(t, err)
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.EqualValues(t, "site", username)
+	assert.EqualValues(t, "pw", password)
+
+	assert.Empty(t, authorization(t, auth, "https://other.example.com/pkg.json"))
+
+	// the match doesn't depend on map order
+	for ix := 0; ix < 20; ix++ {
+		assert.EqualValues(t, "Bearer other-token", authorization(t, newAuthenticators(authCreds, configured), "https://example.com/pkgs/other/pkg.json"))
+	}
+}
+
+func Test_OAuth2ClientCredentials(t *testing.T) {
+	var lock sync.Mutex
+	var requests int
+	expiresIn := 3600
+
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		assert.EqualValues(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.EqualValues(t, "pkgs:read", r.PostForm.Get("scope"))
+
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		requests++
+		token := map[string]interface{}{"access_token": fmt.Sprintf("token-%v", requests), "token_type": "bearer", "expires_in": expiresIn}
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(token)
+	}))
+	defer tokens.Close()
+
+	auth := newAuthenticators(nil, map[string]Authenticator{"": NewOAuth2ClientCredentials(tokens.URL, "client", "secret", "pkgs:read")})
+
+	// the token is reused until it's about to expire
+	assert.EqualValues(t, "Bearer token-1", authorization(t, auth, "https://example.com/pkg.json"))
+	assert.EqualValues(t, "Bearer token-1", authorization(t, auth, "https://example.com/part.tgz"))
+
+	// tokens expiring within the refresh margin are refreshed every time
+	lock.Lock()
+	expiresIn = 5
+	lock.Unlock()
+	auth[0].authenticator.(*OAuth2ClientCredentials).expiry = time.Now()
+	assert.EqualValues(t, "Bearer token-2", authorization(t, auth, "https://example.com/part.tgz"))
+	assert.EqualValues(t, "Bearer token-3", authorization(t, auth, "https://example.com/part.tgz"))
+
+	// a rejected client fails the request
+	rejected := newAuthenticators(nil, map[string]Authenticator{"": NewOAuth2ClientCredentials(tokens.URL, "client", "wrong", "pkgs:read")})
+	_, err := authenticatedRequest(context.Background(), "https://example.com/pkg.json", rejected)
+	assert.NotNil(t, err)
+}
+
+func Test_Netrc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-netrc-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	netrcPath := path.Join(tmpDir, "netrc")
+	assert.Nil(t, ioutil.WriteFile(netrcPath, []byte(`machine mirror.example.com login mirror password mirror-pw
+machine other.example.com
+	login other
+	account ignored
+	password other-pw
+
+macdef init
+	machine macro.example.com login macro password macro-pw
+
+default login anonymous password guest
+`), 0600))
+
+	netrc, err := NewNetrc(netrcPath)
+	assert.Nil(t, err)
+
+	auth := newAuthenticators(nil, map[string]Authenticator{"": netrc})
+
+	for host, expected := range map[string][]string{
+		"mirror.example.com:8443": {"mirror", "mirror-pw"},
+		"other.example.com":       {"other", "other-pw"},
+		"macro.example.com":       {"anonymous", "guest"},
+	} {
+		req, err := authenticatedRequest(context.Background(), fmt.Sprintf("https://%v/pkg.json", host), auth)
+		assert.Nil(t, err)
+		username, password, ok := req.BasicAuth()
+		assert.True(t, ok, host)
+		assert.EqualValues(t, expected, []string{username, password}, host)
+	}
+
+	// without a default entry other hosts go unauthenticated
+	assert.Nil(t, ioutil.WriteFile(netrcPath, []byte("machine mirror.example.com login mirror password mirror-pw\n"), 0600))
+	netrc, err = NewNetrc(netrcPath)
+	assert.Nil(t, err)
+	assert.Empty(t, authorization(t, newAuthenticators(nil, map[string]Authenticator{"": netrc}), "https://other.example.com/pkg.json"))
+
+	_, err = NewNetrc(path.Join(tmpDir, "missing"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,279 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// bundleScheme is the scheme of the URLs by which content of a bundle is
+// requested; the host and all but the last element of their paths are
+// ignored
+const bundleScheme = "bundle"
+
+// bundleTransport serves requests for a Pkg's meta file and parts from a
+// bundle directory. A part is looked up by the base name of the requested
+// URL's path and then, once the Pkg's verified meta file names it, by its ID,
+// each in the bundle's <pkgID> directory and then the bundle directory
+// itself, so the sources recorded in the Pkg needn't mirror the bundle's
+// layout. Range requests are supported.
+type bundleTransport struct {
+	dir   string
+	pkgID string
+	files http.RoundTripper
+
+	lock sync.Mutex
+	// partIDs maps the URLs of parts' sources to the parts' IDs
+	partIDs map[string]string
+}
+
+func newBundleTransport(dir string, pkgID string) *bundleTransport {
+	return &bundleTransport{
+		dir:     dir,
+		pkgID:   pkgID,
+		files:   http.NewFileTransport(http.Dir(dir)),
+		partIDs: make(map[string]string, 0),
+	}
+}
+
+// usePkg learns the IDs of the parts of the given Pkg, whose meta file must
+// have been verified, by the URLs of their sources resolved against the
+// given Pkg URL
+func (t *bundleTransport) usePkg(pkg *horizonpkg.Pkg, pkgURL *url.URL) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, part := range pkg.Parts {
+		for _, source := range part.Sources {
+			if resolved, err := resolveSourceURL(pkgURL, source.URL); err == nil {
+				t.partIDs[resolved] = part.ID
+			}
+		}
+	}
+}
+
+// locate returns the path, relative to the bundle directory, of the first of
+// the named files that exists; the first candidate is returned if none does
+// so that the request fails with a 404
+func (t *bundleTransport) locate(names ...string) string {
+	var candidates []string
+	for _, name := range names {
+		candidates = append(candidates, path.Join("/", t.pkgID, name), path.Join("/", name))
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(filepath.Join(t.dir, filepath.FromSlash(candidate))); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return candidates[0]
+}
+
+func (t *bundleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	names := []string{path.Base(req.URL.Path)}
+
+	t.lock.Lock()
+	if partID, exists := t.partIDs[req.URL.String()]; exists {
+		names = append(names, partID)
+	}
+	t.lock.Unlock()
+
+	located := new(http.Request)
+	*located = *req
+	located.URL = &url.URL{Scheme: "file", Path: t.locate(names...)}
+
+	glog.V(5).Infof("Serving %v from bundle file %v", Redact(req.URL.String()), located.URL.Path)
+	return t.files.RoundTrip(located)
+}
+
+// bundlePkgID returns the ID of the only Pkg in the bundle directory, the one
+// whose meta file and signature are there
+func bundlePkgID(dir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json.sig"))
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+	for _, match := range matches {
+		id := strings.TrimSuffix(filepath.Base(match), ".json.sig")
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) != 1 {
+		return "", fmt.Errorf("Expected exactly one signed Pkg meta file in bundle %v, found %v", dir, ids)
+	}
+	return ids[0], nil
+}
+
+// openBundleArchive opens the tar archive, optionally gzipped, at the given
+// path; the returned function closes it
+func openBundleArchive(archivePath string) (*tar.Reader, func(), error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), func() { gz.Close(); file.Close() }, nil
+	}
+
+	return tar.NewReader(buffered), func() { file.Close() }, nil
+}
+
+// bundleArchiveBytes sums the sizes of the regular files in the bundle
+// archive at the given path, the space its extraction takes
+func bundleArchiveBytes(archivePath string) (int64, error) {
+	archive, closeArchive, err := openBundleArchive(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer closeArchive()
+
+	var total int64
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("Unable to read bundle archive %v. Error: %v", archivePath, err)
+		}
+
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			total += header.Size
+		}
+	}
+}
+
+// extractBundle unpacks the tar archive, optionally gzipped, at the given
+// path into dir. Only regular files and directories are extracted; entries
+// that would land outside dir are refused.
+func extractBundle(archivePath string, dir string) error {
+	archive, closeArchive, err := openBundleArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	defer closeArchive()
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to read bundle archive %v. Error: %v", archivePath, err)
+		}
+
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, archive)
+			out.Close()
+			if err != nil {
+				return fmt.Errorf("Unable to extract %v from bundle archive %v. Error: %v", header.Name, archivePath, err)
+			}
+		default:
+			glog.V(3).Infof("Ignoring entry %v of unsupported type in bundle archive %v", header.Name, archivePath)
+		}
+	}
+}
+
+// PkgFetchBundle fetches a Pkg from a bundle carried to a site without
+// network access rather than from the Pkg's sources. The bundle is either a
+// directory or a tar archive, optionally gzipped, containing the Pkg meta
+// file <pkgID>.json, its signature <pkgID>.json.sig and the Pkg's parts,
+// either in a <pkgID> directory or alongside the meta file. Parts are named
+// by their ID or the last path element of one of their source URLs. If
+// pkgID is empty, the bundle must contain a single Pkg.
+//
+// The meta file and parts are verified as they would be if fetched over the
+// network and destinationDir is populated the same way, so a Pkg fetched
+// from a bundle may be fetched again with PkgFetch and vice versa.
+func PkgFetchBundle(ctx context.Context, skipPartFetchFn *func(repotag string) (bool, error), bundlePath string, pkgID string, destinationDir string, keyFiles []string, options *Options) (*FetchResult, error) {
+	info, err := os.Stat(bundlePath)
+	if err != nil {
+		return nil, fetcherrors.PkgSourceError{fmt.Sprintf("Unable to read bundle %v", bundlePath), err}
+	}
+
+	bundleDir := bundlePath
+	if !info.IsDir() {
+		// extracted into the destination directory, where it's sure to be
+		// writable, and removed once its parts have been copied into place
+		if err := os.MkdirAll(destinationDir, 0700); err != nil {
+			return nil, fetcherrors.PkgSourceError{"Failed creating Pkg destination dirs on host", err}
+		}
+
+		if err := precheckBundleSpace(bundlePath, destinationDir, options.withDefaults()); err != nil {
+			return nil, err
+		}
+
+		bundleDir, err = ioutil.TempDir(destinationDir, ".bundle-")
+		if err != nil {
+			return nil, fetcherrors.PkgSourceError{"Unable to create directory to extract bundle", err}
+		}
+		defer os.RemoveAll(bundleDir)
+
+		if err := extractBundle(bundlePath, bundleDir); err != nil {
+			return nil, fetcherrors.PkgSourceError{fmt.Sprintf("Unable to extract bundle %v", bundlePath), err}
+		}
+	}
+
+	if pkgID == "" {
+		if pkgID, err = bundlePkgID(bundleDir); err != nil {
+			return nil, fetcherrors.PkgMetaError{"Unable to find Pkg in bundle", err}
+		}
+	} else if err := checkPkgID(pkgID); err != nil {
+		return nil, fetcherrors.PkgMetaError{"Unable to find Pkg in bundle", err}
+	}
+
+	sig, err := ioutil.ReadFile(filepath.Join(bundleDir, pkgID+".json.sig"))
+	if err != nil {
+		return nil, fetcherrors.PkgMetaError{fmt.Sprintf("Unable to read signature of Pkg %v from bundle", pkgID), err}
+	}
+
+	client := &http.Client{Transport: newBundleTransport(bundleDir, pkgID)}
+	clientFactory := func(overrideTimeoutS *uint) *http.Client {
+		return client
+	}
+
+	pkgURL := url.URL{Scheme: bundleScheme, Path: fmt.Sprintf("/%v.json", pkgID)}
+	return PkgFetchWithResult(ctx, clientFactory, skipPartFetchFn, pkgURL, strings.TrimSpace(string(sig)), destinationDir, keyFiles, nil, options)
+}
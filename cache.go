@@ -0,0 +1,179 @@
+package fetch
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"path"
+	"regexp"
+)
+
+// LinkMode selects how Pkg directories reference the content of a PartCache
+type LinkMode string
+
+const (
+	// LinkHard makes each part in a Pkg directory a hard link to its cache
+	// entry. If the Pkg directory and the cache are on different file
+	// systems, a symbolic link is made instead.
+	LinkHard LinkMode = "HARD"
+
+	// LinkSymbolic makes each part in a Pkg directory a symbolic link to its
+	// cache entry
+	LinkSymbolic LinkMode = "SYMBOLIC"
+)
+
+// sha256sumPattern matches the hex encoded SHA-256 digests that name cache
+// entries; anything else is refused so that a Pkg can't name a path outside
+// the cache
+var sha256sumPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// PartCache is a content-addressed store of verified parts, keyed by their
+// SHA-256 digest and shared by all Pkgs fetched with it. A part already in
+// the cache is linked into a Pkg's directory rather than downloaded; it's
+// verified like any other part before it's accepted.
+type PartCache struct {
+	Dir  string
+	Mode LinkMode
+}
+
+// NewPartCache returns a cache in the given directory, creating it if
+// necessary. An empty mode selects LinkHard.
+func NewPartCache(dir string, mode LinkMode) (*PartCache, error) {
+	if mode == "" {
+		mode = LinkHard
+	} else if mode != LinkHard && mode != LinkSymbolic {
+		return nil, fmt.Errorf("Unknown part cache link mode: %v", mode)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create part cache directory %v. Error: %v", dir, err)
+	}
+
+	return &PartCache{Dir: dir, Mode: mode}, nil
+}
+
+// EntryPath returns the path of the cache entry of the part with the given
+// SHA-256 digest or an error if the digest is malformed. The entry needn't
+// exist.
+func (c *PartCache) EntryPath(sha256sum string) (string, error) {
+	if !sha256sumPattern.MatchString(sha256sum) {
+		return "", fmt.Errorf("Illegal part cache key: %v", sha256sum)
+	}
+
+	return path.Join(c.Dir, sha256sum), nil
+}
+
+// link references the cache entry of the given digest from partPath if the
+// entry exists with the given size and nothing is at partPath yet. It returns
+// true if the link was made.
+func (c *PartCache) link(sha256sum string, bytes int64, partPath string) (bool, error) {
+	entryPath, err := c.EntryPath(sha256sum)
+	if err != nil {
+		return false, err
+	}
+
+	if info, err := os.Stat(entryPath); err != nil || info.Size() != bytes {
+		return false, nil
+	}
+
+	if _, err := os.Lstat(partPath); err == nil {
+		return false, nil
+	}
+
+	if c.Mode == LinkHard {
+		err := os.Link(entryPath, partPath)
+		if err == nil {
+			return true, nil
+		}
+		glog.V(3).Infof("Unable to hard link cache entry %v to %v, making a symbolic link instead. Error: %v", entryPath, partPath, err)
+	}
+
+	if err := os.Symlink(entryPath, partPath); err != nil {
+		return false, fmt.Errorf("Unable to link cache entry %v to %v. Error: %v", entryPath, partPath, err)
+	}
+	return true, nil
+}
+
+// store adds the verified part at partPath to the cache unless it's there
+// already. In LinkSymbolic mode the part's content is moved into the cache
+// and partPath replaced by a link to it.
+func (c *PartCache) store(partPath string, sha256sum string) error {
+	entryPath, err := c.EntryPath(sha256sum)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(entryPath); err == nil {
+		return nil
+	}
+
+	if info, err := os.Lstat(partPath); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		// already references content elsewhere
+		return nil
+	}
+
+	tempPath := tempPartPath(entryPath)
+	defer os.Remove(tempPath)
+
+	if c.Mode == LinkHard {
+		if err := os.Link(partPath, tempPath); err != nil {
+			glog.V(3).Infof("Unable to hard link %v into the part cache, copying it instead. Error: %v", partPath, err)
+			if err := copyFile(partPath, tempPath); err != nil {
+				return err
+			}
+		}
+		return commitPart(tempPath, entryPath)
+	}
+
+	if err := copyFile(partPath, tempPath); err != nil {
+		return err
+	}
+	if err := commitPart(tempPath, entryPath); err != nil {
+		return err
+	}
+
+	// the Pkg's copy is swapped for a link atomically
+	pkgTempPath := tempPartPath(partPath)
+	if err := os.Symlink(entryPath, pkgTempPath); err != nil {
+		return err
+	}
+	return os.Rename(pkgTempPath, partPath)
+}
+
+// evict removes the cache entry of the given digest, say if it turned out to
+// be corrupt; parts already linked to it are unaffected
+func (c *PartCache) evict(sha256sum string) error {
+	entryPath, err := c.EntryPath(sha256sum)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(entryPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the content of the file at src to a new file at dst and
+// syncs it
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
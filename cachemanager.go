@@ -0,0 +1,425 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pinSuffix names the file that pins a Pkg in a destination directory
+const pinSuffix = ".pin"
+
+// CacheManager manages the Pkgs fetched into a destination directory and the
+// entries of the part cache, if any, used by those fetches. It bounds the
+// disk space used by evicting the least recently used Pkgs and removing
+// content no retained Pkg references. Pinned Pkgs, such as those in use by
+// running agreements, are never evicted. A Pkg's last use is the last time
+// it was fetched or Touch()ed.
+//
+// The manager's state is kept in the destination directory itself so that
+// separate processes, like a running agent and the cache command, share it.
+// Pkgs that are being fetched aren't removed.
+type CacheManager struct {
+	DestinationDir string
+	PartCache      *PartCache // may be nil if fetches don't use one
+}
+
+// CachedPkg describes a Pkg in a destination directory
+type CachedPkg struct {
+	PkgID     string
+	Bytes     int64 // the size of the Pkg's parts on disk, counting content shared with other Pkgs
+	LastUsed  time.Time
+	Pinned    bool
+	PinReason string
+}
+
+// CacheReport describes the effect of trimming the cache
+type CacheReport struct {
+	Evicted     []string // the IDs of the Pkgs evicted
+	Removed     []string // the paths of files and directories removed
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// NewCacheManager returns a manager of the given destination directory and
+// part cache, which may be nil
+func NewCacheManager(destinationDir string, partCache *PartCache) *CacheManager {
+	return &CacheManager{
+		DestinationDir: destinationDir,
+		PartCache:      partCache,
+	}
+}
+
+func (m *CacheManager) metaPath(pkgID string) string {
+	return path.Join(m.DestinationDir, fmt.Sprintf("%v.json", pkgID))
+}
+
+func (m *CacheManager) pinPath(pkgID string) string {
+	return path.Join(m.DestinationDir, pkgID+pinSuffix)
+}
+
+// checkPkgID refuses IDs that would name paths outside the destination
+// directory
+func checkPkgID(pkgID string) error {
+	if pkgID == "" || pkgID != path.Base(pkgID) || strings.HasPrefix(pkgID, ".") {
+		return fmt.Errorf("Illegal Pkg ID: %v", pkgID)
+	}
+	return nil
+}
+
+// Pkgs lists the Pkgs in the destination directory, least recently used
+// first
+func (m *CacheManager) Pkgs() ([]CachedPkg, error) {
+	infos, err := ioutil.ReadDir(m.DestinationDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []CachedPkg
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		pkgID := strings.TrimSuffix(info.Name(), ".json")
+		cached := CachedPkg{PkgID: pkgID, LastUsed: info.ModTime()}
+
+		if manifest, err := os.Stat(manifestPath(m.DestinationDir, pkgID)); err == nil {
+			cached.LastUsed = manifest.ModTime()
+		}
+
+		if reason, err := ioutil.ReadFile(m.pinPath(pkgID)); err == nil {
+			cached.Pinned = true
+			cached.PinReason = string(reason)
+		}
+
+		if cached.Bytes, err = diskUsage([]string{path.Join(m.DestinationDir, pkgID)}); err != nil {
+			return nil, err
+		}
+
+		pkgs = append(pkgs, cached)
+	}
+
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].LastUsed.Before(pkgs[j].LastUsed)
+	})
+	return pkgs, nil
+}
+
+// Pin protects the Pkg with the given ID from eviction, recording the reason
+// for it
+func (m *CacheManager) Pin(pkgID string, reason string) error {
+	if err := checkPkgID(pkgID); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(m.metaPath(pkgID)); err != nil {
+		return fmt.Errorf("Unable to pin Pkg %v. Error: %v", pkgID, err)
+	}
+
+	return ioutil.WriteFile(m.pinPath(pkgID), []byte(reason), 0600)
+}
+
+// Unpin makes the Pkg with the given ID subject to eviction again
+func (m *CacheManager) Unpin(pkgID string) error {
+	if err := checkPkgID(pkgID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(m.pinPath(pkgID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Touch marks the Pkg with the given ID used now
+func (m *CacheManager) Touch(pkgID string) error {
+	if err := checkPkgID(pkgID); err != nil {
+		return err
+	}
+
+	return touchPkg(m.DestinationDir, pkgID)
+}
+
+// Remove deletes the Pkg with the given ID from the destination directory.
+// Pinned Pkgs can't be removed. Part cache entries are left for GC.
+func (m *CacheManager) Remove(pkgID string) error {
+	if err := checkPkgID(pkgID); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(m.pinPath(pkgID)); err == nil {
+		return fmt.Errorf("Pkg %v is pinned, unpin it before removal", pkgID)
+	}
+
+	_, err := m.remove(pkgID)
+	if err == errLockHeld {
+		return fmt.Errorf("Pkg %v is being fetched, try again later", pkgID)
+	}
+	return err
+}
+
+// remove deletes the Pkg's meta file last so that an interrupted removal
+// still leaves it listed. It returns errLockHeld if the Pkg is being fetched.
+func (m *CacheManager) remove(pkgID string) ([]string, error) {
+	lock, err := tryLock(lockPath(m.DestinationDir, pkgID), true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	var removed []string
+	for _, pp := range []string{
+		manifestPath(m.DestinationDir, pkgID),
+		validatorsPath(m.DestinationDir, pkgID),
+		path.Join(m.DestinationDir, pkgID),
+		m.metaPath(pkgID),
+	} {
+		if _, err := os.Lstat(pp); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := os.RemoveAll(pp); err != nil {
+			return removed, fmt.Errorf("Unable to remove %v of Pkg %v. Error: %v", pp, pkgID, err)
+		}
+		removed = append(removed, pp)
+	}
+
+	glog.V(3).Infof("Removed Pkg %v from %v", pkgID, m.DestinationDir)
+	return removed, nil
+}
+
+// Usage returns the bytes used by the destination directory and the part
+// cache, counting content linked into several places once
+func (m *CacheManager) Usage() (int64, error) {
+	dirs := []string{m.DestinationDir}
+	if m.PartCache != nil {
+		dirs = append(dirs, m.PartCache.Dir)
+	}
+	return diskUsage(dirs)
+}
+
+// isPartCacheDir reports if the given path is the part cache's directory,
+// which may be kept in the destination directory
+func (m *CacheManager) isPartCacheDir(pp string) bool {
+	if m.PartCache == nil {
+		return false
+	}
+
+	info, err := os.Stat(pp)
+	if err != nil {
+		return false
+	}
+	cacheInfo, err := os.Stat(m.PartCache.Dir)
+	return err == nil && os.SameFile(info, cacheInfo)
+}
+
+// GC removes part cache entries that no Pkg in the destination directory
+// references, files in Pkg directories that aren't parts of the Pkg, and Pkg
+// directories and pins of Pkgs that no longer exist. Temporary files of
+// downloads in progress are left alone, as is the part cache if it's kept in
+// the destination directory.
+func (m *CacheManager) GC() (*CacheReport, error) {
+	before, err := m.Usage()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CacheReport{BytesBefore: before}
+
+	infos, err := ioutil.ReadDir(m.DestinationDir)
+	if err != nil {
+		return nil, err
+	}
+
+	remove := func(pp string) {
+		if err := os.RemoveAll(pp); err != nil {
+			glog.Errorf("Unable to remove %v during GC. Error: %v", pp, err)
+			return
+		}
+		report.Removed = append(report.Removed, pp)
+	}
+
+	// the digests of every part of a retained Pkg
+	referenced := make(map[string]bool, 0)
+
+	for _, info := range infos {
+		name := info.Name()
+		pp := path.Join(m.DestinationDir, name)
+
+		switch {
+		case strings.HasPrefix(name, "."):
+			// lock files and temporary files and directories, like extracted bundles
+			continue
+
+		case info.IsDir() && m.isPartCacheDir(pp):
+			continue
+
+		case info.IsDir():
+			raw, err := ioutil.ReadFile(m.metaPath(name))
+			if os.IsNotExist(err) {
+				remove(pp)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			var pkg horizonpkg.Pkg
+			if err := json.Unmarshal(raw, &pkg); err != nil {
+				// unreadable metadata can't be trusted to tell what's referenced
+				return nil, fmt.Errorf("Unable to read metadata of Pkg %v. Error: %v", name, err)
+			}
+
+			for _, part := range pkg.Parts {
+				referenced[part.Sha256sum] = true
+			}
+
+			parts, err := ioutil.ReadDir(pp)
+			if err != nil {
+				return nil, err
+			}
+			for _, part := range parts {
+				if _, exists := pkg.Parts[part.Name()]; !exists && tempPartID(part.Name()) == "" && !strings.HasSuffix(part.Name(), resumeSuffix) && !strings.HasSuffix(part.Name(), lockSuffix) {
+					remove(path.Join(pp, part.Name()))
+				}
+			}
+
+		case strings.HasSuffix(name, pinSuffix), strings.HasSuffix(name, manifestSuffix), strings.HasSuffix(name, validatorsSuffix):
+			pkgID := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, pinSuffix), manifestSuffix), validatorsSuffix)
+			if _, err := os.Stat(m.metaPath(pkgID)); os.IsNotExist(err) {
+				remove(pp)
+			}
+		}
+	}
+
+	if m.PartCache != nil {
+		entries, err := ioutil.ReadDir(m.PartCache.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if sha256sumPattern.MatchString(entry.Name()) && !referenced[entry.Name()] {
+				remove(path.Join(m.PartCache.Dir, entry.Name()))
+			}
+		}
+	}
+
+	if report.BytesAfter, err = m.Usage(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// EnforceQuota evicts the least recently used unpinned Pkgs, collecting
+// garbage after each, until the destination directory and part cache use no
+// more than quota bytes. An error is returned with the report if the quota
+// can't be met by evicting every unpinned Pkg.
+func (m *CacheManager) EnforceQuota(quota int64) (*CacheReport, error) {
+	report, err := m.GC()
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs, err := m.Pkgs()
+	if err != nil {
+		return report, err
+	}
+
+	for _, pkg := range pkgs {
+		if report.BytesAfter <= quota {
+			return report, nil
+		} else if pkg.Pinned {
+			continue
+		}
+
+		glog.V(3).Infof("Evicting Pkg %v, last used %v, to meet disk quota of %v bytes", pkg.PkgID, pkg.LastUsed, quota)
+		removed, err := m.remove(pkg.PkgID)
+		report.Removed = append(report.Removed, removed...)
+		if err == errLockHeld {
+			glog.V(3).Infof("Not evicting Pkg %v, it's being fetched", pkg.PkgID)
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		report.Evicted = append(report.Evicted, pkg.PkgID)
+
+		gc, err := m.GC()
+		if err != nil {
+			return report, err
+		}
+		report.Removed = append(report.Removed, gc.Removed...)
+		report.BytesAfter = gc.BytesAfter
+	}
+
+	if report.BytesAfter > quota {
+		return report, fmt.Errorf("Unable to meet disk quota of %v bytes, %v bytes are used by pinned Pkgs and other content", quota, report.BytesAfter)
+	}
+	return report, nil
+}
+
+// touchPkg marks a fetched Pkg used now by updating its manifest's
+// modification time
+func touchPkg(destinationDir string, pkgID string) error {
+	now := time.Now()
+	return os.Chtimes(manifestPath(destinationDir, pkgID), now, now)
+}
+
+// diskUsage sums the sizes of the regular files under the given paths and
+// those symbolically linked from them, counting each file linked into
+// several places once
+func diskUsage(paths []string) (int64, error) {
+	type fileID struct {
+		dev uint64
+		ino uint64
+	}
+	seen := make(map[fileID]bool, 0)
+
+	var total int64
+	for _, root := range paths {
+		err := filepath.Walk(root, func(pp string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				// parts linked from a part cache count as the content they link to
+				if target, err := os.Stat(pp); err == nil {
+					info = target
+				}
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				id := fileID{uint64(stat.Dev), uint64(stat.Ino)}
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+
+			total += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
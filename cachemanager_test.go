@@ -0,0 +1,184 @@
+// +build unit
+
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeCachedPkg lays out a fetched Pkg with the given part contents in
+// destinationDir as a fetch with the given cache would, last used at the
+// given time
+func writeCachedPkg(t *testing.T, destinationDir string, cache *PartCache, pkgID string, lastUsed time.Time, contents ...string) {
+	pkg := horizonpkg.Pkg{ID: pkgID, Parts: make(horizonpkg.DockerImageParts, 0)}
+	manifest := &FetchManifest{PkgID: pkgID, Parts: make(map[string]ManifestPart, 0)}
+
+	pkgDir := path.Join(destinationDir, pkgID)
+	assert.Nil(t, os.MkdirAll(pkgDir, 0700))
+
+	for _, content := range contents {
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		pkg.Parts[sum] = horizonpkg.DockerImagePart{ID: sum, Sha256sum: sum, Bytes: int64(len(content))}
+
+		partPath := path.Join(pkgDir, sum)
+		linked, err := cache.link(sum, int64(len(content)), partPath)
+		assert.Nil(t, err)
+		if !linked {
+			assert.Nil(t, ioutil.WriteFile(partPath, []byte(content), 0600))
+			assert.Nil(t, cache.store(partPath, sum))
+		}
+		manifest.Parts["image:"+sum[:8]] = ManifestPart{PartID: sum, Path: partPath, Bytes: int64(len(content)), Sha256sum: sum}
+	}
+
+	raw, err := json.Marshal(pkg)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path.Join(destinationDir, pkgID+".json"), raw, 0600))
+	assert.Nil(t, writeFetchManifest(destinationDir, manifest))
+	assert.Nil(t, os.Chtimes(manifestPath(destinationDir, pkgID), lastUsed, lastUsed))
+}
+
+func Test_CacheManager_Suite(suite *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-cachemanager-")
+	assert.Nil(suite, err)
+	defer os.RemoveAll(tmpDir)
+
+	part := func(b byte) string {
+		content := make([]byte, 1000)
+		for ix := range content {
+			content[ix] = b
+		}
+		return string(content)
+	}
+
+	now := time.Now()
+
+	suite.Run("shared parts are stored and counted once", func(t *testing.T) {
+		destinationDir := path.Join(tmpDir, "shared")
+		cache, err := NewPartCache(path.Join(tmpDir, "shared-cache"), LinkHard)
+		assert.Nil(t, err)
+
+		writeCachedPkg(t, destinationDir, cache, "old", now.Add(-2*time.Hour), part('a'), part('b'))
+		writeCachedPkg(t, destinationDir, cache, "new", now, part('b'), part('c'))
+
+		manager := NewCacheManager(destinationDir, cache)
+		pkgs, err := manager.Pkgs()
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(pkgs))
+		assert.EqualValues(t, "old", pkgs[0].PkgID)
+		assert.EqualValues(t, 2000, pkgs[0].Bytes)
+
+		// three distinct parts plus metadata
+		expected := int64(3000)
+		for _, pkgID := range []string{"old", "new"} {
+			for _, pp := range []string{path.Join(destinationDir, pkgID+".json"), manifestPath(destinationDir, pkgID)} {
+				info, err := os.Stat(pp)
+				assert.Nil(t, err)
+				expected += info.Size()
+			}
+		}
+
+		usage, err := manager.Usage()
+		assert.Nil(t, err)
+		assert.EqualValues(t, expected, usage)
+	})
+
+	suite.Run("GC removes unreferenced content", func(t *testing.T) {
+		destinationDir := path.Join(tmpDir, "gc")
+		cache, err := NewPartCache(path.Join(tmpDir, "gc-cache"), LinkSymbolic)
+		assert.Nil(t, err)
+
+		writeCachedPkg(t, destinationDir, cache, "kept", now, part('a'))
+		writeCachedPkg(t, destinationDir, cache, "gone", now, part('b'))
+
+		// a Pkg removed out from under the manager, leaving its part in the cache
+		manager := NewCacheManager(destinationDir, cache)
+		assert.Nil(t, manager.Remove("gone"))
+
+		stray := path.Join(destinationDir, "kept", "stray")
+		assert.Nil(t, ioutil.WriteFile(stray, []byte("stray"), 0600))
+		inProgress := tempPartPath(path.Join(destinationDir, "kept", "downloading"))
+		assert.Nil(t, ioutil.WriteFile(inProgress, []byte("partial"), 0600))
+		orphan := path.Join(destinationDir, "orphan")
+		assert.Nil(t, os.MkdirAll(orphan, 0700))
+
+		report, err := manager.GC()
+		assert.Nil(t, err)
+		assert.True(t, report.BytesAfter < report.BytesBefore)
+
+		goneEntry, _ := cache.EntryPath(fmt.Sprintf("%x", sha256.Sum256([]byte(part('b')))))
+		keptEntry, _ := cache.EntryPath(fmt.Sprintf("%x", sha256.Sum256([]byte(part('a')))))
+		assert.ElementsMatch(t, []string{goneEntry, stray, orphan}, report.Removed)
+
+		_, err = os.Stat(keptEntry)
+		assert.Nil(t, err)
+		_, err = os.Stat(inProgress)
+		assert.Nil(t, err)
+	})
+
+	suite.Run("GC keeps a part cache inside the destination directory", func(t *testing.T) {
+		destinationDir := path.Join(tmpDir, "gc-inside")
+		cache, err := NewPartCache(path.Join(destinationDir, "cache"), LinkHard)
+		assert.Nil(t, err)
+
+		writeCachedPkg(t, destinationDir, cache, "kept", now, part('a'))
+		orphan := path.Join(destinationDir, "orphan")
+		assert.Nil(t, os.MkdirAll(orphan, 0700))
+
+		report, err := NewCacheManager(destinationDir, cache).GC()
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{orphan}, report.Removed)
+
+		keptEntry, _ := cache.EntryPath(fmt.Sprintf("%x", sha256.Sum256([]byte(part('a')))))
+		_, err = os.Stat(keptEntry)
+		assert.Nil(t, err)
+	})
+
+	suite.Run("EnforceQuota evicts least recently used unpinned Pkgs", func(t *testing.T) {
+		destinationDir := path.Join(tmpDir, "quota")
+		cache, err := NewPartCache(path.Join(tmpDir, "quota-cache"), LinkHard)
+		assert.Nil(t, err)
+
+		writeCachedPkg(t, destinationDir, cache, "oldest", now.Add(-3*time.Hour), part('a'))
+		writeCachedPkg(t, destinationDir, cache, "older", now.Add(-2*time.Hour), part('b'))
+		writeCachedPkg(t, destinationDir, cache, "newest", now, part('c'))
+
+		manager := NewCacheManager(destinationDir, cache)
+		assert.Nil(t, manager.Pin("oldest", "agreement 1"))
+		assert.NotNil(t, manager.Remove("oldest"))
+		assert.NotNil(t, manager.Pin("../escape", ""))
+
+		usage, err := manager.Usage()
+		assert.Nil(t, err)
+
+		// making room for one part evicts the least recently used unpinned Pkg only
+		report, err := manager.EnforceQuota(usage - 500)
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{"older"}, report.Evicted)
+		assert.True(t, report.BytesAfter <= usage-500)
+
+		pkgs, err := manager.Pkgs()
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(pkgs))
+		assert.True(t, pkgs[0].Pinned)
+		assert.EqualValues(t, "agreement 1", pkgs[0].PinReason)
+
+		// pinned Pkgs stay even if the quota can't be met
+		report, err = manager.EnforceQuota(0)
+		assert.NotNil(t, err)
+		assert.EqualValues(t, []string{"newest"}, report.Evicted)
+
+		assert.Nil(t, manager.Unpin("oldest"))
+		report, err = manager.EnforceQuota(0)
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{"oldest"}, report.Evicted)
+	})
+}
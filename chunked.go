@@ -0,0 +1,341 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// errRangesUnsupported is the failure of a chunk download from a source that
+// ignored the range request
+var errRangesUnsupported = errors.New("Source does not support range requests")
+
+// ChunkPolicy configures downloading large parts in byte ranges, fetched
+// concurrently and spread across all of a part's sources. Sources that don't
+// support range requests are passed over; if none do, or the chunked download
+// fails, the part is downloaded in a single stream instead.
+type ChunkPolicy struct {
+	MinPartBytes        int64 // parts smaller than this are downloaded in a single stream
+	ChunkBytes          int64 // the size of each byte range requested
+	MaxConcurrentChunks int   // the number of ranges of a part downloaded at once; values less than 1 mean 1
+}
+
+// DefaultChunkPolicy returns a policy suitable for parts large enough that
+// parallel downloads from several mirrors pay off
+func DefaultChunkPolicy() *ChunkPolicy {
+	return &ChunkPolicy{
+		MinPartBytes:        64 * 1024 * 1024,
+		ChunkBytes:          8 * 1024 * 1024,
+		MaxConcurrentChunks: 4,
+	}
+}
+
+// applies reports if a part of the given size should be downloaded in chunks
+func (p *ChunkPolicy) applies(expectedBytes int64) bool {
+	return p != nil && p.ChunkBytes > 0 && expectedBytes >= p.MinPartBytes && expectedBytes > p.ChunkBytes
+}
+
+func (p *ChunkPolicy) maxConcurrentChunks() int {
+	if p.MaxConcurrentChunks < 1 {
+		return 1
+	}
+	return p.MaxConcurrentChunks
+}
+
+// chunk is a byte range of a part
+type chunk struct {
+	index  int
+	start  int64
+	length int64
+}
+
+func (c chunk) rangeHeader() string {
+	return fmt.Sprintf("bytes=%d-%d", c.start, c.start+c.length-1)
+}
+
+// chunkSources tracks which of a part's sources are still usable for range
+// requests
+type chunkSources struct {
+	lock        *sync.Mutex
+	urls        []string
+	unsupported map[string]bool
+}
+
+// pick returns a usable source for the given try at a chunk, rotating through
+// the sources so that chunks are spread across them and retries move on to
+// the next one. It returns the empty string if no source is usable.
+func (s *chunkSources) pick(c chunk, try int) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for ix := 0; ix < len(s.urls); ix++ {
+		pURL := s.urls[(c.index+try-1+ix)%len(s.urls)]
+		if !s.unsupported[pURL] {
+			return pURL
+		}
+	}
+	return ""
+}
+
+func (s *chunkSources) markUnsupported(pURL string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unsupported[pURL] = true
+}
+
+// chunkProgress sums the bytes written by concurrent chunk downloads into a
+// part's progress
+type chunkProgress struct {
+	lock     *sync.Mutex
+	bytes    int64
+	progress *partProgress
+}
+
+func (p *chunkProgress) add(bytes int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.bytes += bytes
+	p.progress.downloaded(p.bytes)
+}
+
+// chunkWriter writes a chunk's content at its offset in the part file
+type chunkWriter struct {
+	file     *os.File
+	offset   int64
+	written  int64
+	progress *chunkProgress
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	n, err := w.file.WriteAt(b, w.offset+w.written)
+	w.written += int64(n)
+	w.progress.add(int64(n))
+	return n, err
+}
+
+// fetchChunkFromSource downloads a single chunk of the part from the given
+// URL into its place in partFile
+func fetchChunkFromSource(ctx context.Context, client *http.Client, auth authenticators, pURL string, partFile *os.File, c chunk, options *Options, progress *chunkProgress) (failure *partFetchFailure, err error) {
+	req, err := authenticatedRequest(ctx, pURL, auth)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", c.rangeHeader())
+
+	if options.HostConnections != nil {
+		release, ok := options.HostConnections.acquire(ctx, req.URL.Host)
+		if !ok {
+			return nil, ctx.Err()
+		}
+		defer release()
+	}
+
+	request := options.SourceHealth.request(req.URL.Host)
+	defer func() { request.done(ctx, failure == nil && err == nil, failure) }()
+
+	response, err := client.Do(req)
+	if err != nil {
+		return &partFetchFailure{0, pURL, err}, nil
+	}
+	defer response.Body.Close()
+	request.response()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(response.Header.Get("Content-Range"))
+		if err != nil || start != c.start {
+			return &partFetchFailure{response.StatusCode, pURL, fmt.Errorf("Unexpected Content-Range in response: %v", response.Header.Get("Content-Range"))}, nil
+		}
+	case http.StatusOK:
+		return &partFetchFailure{response.StatusCode, pURL, errRangesUnsupported}, nil
+	default:
+		return &partFetchFailure{response.StatusCode, pURL, nil}, nil
+	}
+
+	var body io.Reader = response.Body
+	if options.Bandwidth != nil {
+		body = throttledReader{ctx, options.Bandwidth, body}
+	}
+
+	writer := &chunkWriter{file: partFile, offset: c.start, progress: progress}
+	_, err = io.CopyN(writer, body, c.length)
+	request.bytes = writer.written
+	if err != nil {
+		// a retry starts the chunk over
+		progress.add(-writer.written)
+		return &partFetchFailure{response.StatusCode, pURL, err}, nil
+	}
+
+	return nil, nil
+}
+
+// fetchPkgPartChunked downloads the part into partFile in chunks, each from
+// one of the given source URLs and retried per the options' RetryPolicy from
+// the next usable source. Once all chunks are written the file is hashed and
+// its digest returned. An error is returned if any chunk couldn't be fetched.
+func fetchPkgPartChunked(ctx context.Context, client *http.Client, auth authenticators, partFile *os.File, expectedBytes int64, urls []string, options *Options, state *partFetch) ([]byte, error) {
+	policy := options.ChunkPolicy
+	partPath := partFile.Name()
+
+	// content of an earlier single stream download can't be resumed in chunks
+	removeResumeState(partPath)
+	if err := partFile.Truncate(0); err != nil {
+		return nil, err
+	}
+	if err := partFile.Truncate(expectedBytes); err != nil {
+		return nil, err
+	}
+
+	var chunks []chunk
+	for start := int64(0); start < expectedBytes; start += policy.ChunkBytes {
+		length := policy.ChunkBytes
+		if start+length > expectedBytes {
+			length = expectedBytes - start
+		}
+		chunks = append(chunks, chunk{len(chunks), start, length})
+	}
+
+	glog.V(3).Infof("Downloading part %v in %v chunks from %v", partPath, len(chunks), redactURLs(urls))
+
+	chunkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sources := &chunkSources{lock: &sync.Mutex{}, urls: urls, unsupported: make(map[string]bool, 0)}
+	progress := &chunkProgress{lock: &sync.Mutex{}, progress: state.progress}
+	progress.add(0)
+
+	var lock sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	record := func(attempt FetchAttempt) {
+		lock.Lock()
+		defer lock.Unlock()
+		if state.sourceURL == "" && attempt.Err == nil {
+			state.sourceURL = attempt.URL
+		}
+		state.record(options, attempt)
+	}
+
+	fetchChunk := func(c chunk) error {
+		retryPolicy := options.RetryPolicy
+		// every source gets its due number of attempts at each chunk
+		maxTries := retryPolicy.maxAttempts() * len(urls)
+
+		for try := 1; try <= maxTries; try++ {
+			pURL := sources.pick(c, try)
+			if pURL == "" {
+				return errRangesUnsupported
+			}
+
+			attempt := FetchAttempt{
+				PartID:        tempPartID(path.Base(partPath)),
+				URL:           pURL,
+				Range:         c.rangeHeader(),
+				PartAttempt:   state.attempt,
+				SourceAttempt: try,
+				StartedAt:     time.Now(),
+			}
+
+			failure, err := fetchChunkFromSource(chunkCtx, client, auth, pURL, partFile, c, options, progress)
+			attempt.Duration = time.Since(attempt.StartedAt)
+
+			if chunkCtx.Err() != nil {
+				return chunkCtx.Err()
+			} else if err != nil {
+				attempt.Err = err
+				record(attempt)
+				return err
+			} else if failure == nil {
+				record(attempt)
+				return nil
+			}
+
+			attempt.HTTPStatusCode = failure.HTTPStatusCode
+			attempt.Err = failure.Err
+			if attempt.Err == nil {
+				attempt.Err = fmt.Errorf("Unexpected HTTP status code: %v", failure.HTTPStatusCode)
+			}
+
+			if failure.Err == errRangesUnsupported {
+				glog.V(3).Infof("Source %v does not support range requests, not using it for chunks of part %v", Redact(pURL), partPath)
+				sources.markUnsupported(pURL)
+				record(attempt)
+				continue
+			}
+
+			retry := try < maxTries && retryPolicy.retryable(failure)
+			if retry {
+				attempt.Backoff = retryPolicy.Backoff((try-1)/len(urls) + 1)
+			}
+			record(attempt)
+
+			if !retry {
+				return attempt.Err
+			}
+
+			if !sleep(chunkCtx, attempt.Backoff) {
+				return chunkCtx.Err()
+			}
+		}
+
+		return fmt.Errorf("Chunk %v of part %v could not be fetched from any source", c.rangeHeader(), partPath)
+	}
+
+	queue := make(chan chunk, len(chunks))
+	for _, c := range chunks {
+		queue <- c
+	}
+	close(queue)
+
+	workers := policy.maxConcurrentChunks()
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+
+	var group sync.WaitGroup
+	for ix := 0; ix < workers; ix++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for c := range queue {
+				if chunkCtx.Err() != nil {
+					return
+				}
+
+				if err := fetchChunk(c); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	group.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if err := partFile.Sync(); err != nil {
+		return nil, fmt.Errorf("Unable to sync part %v to disk. Error: %v", partPath, err)
+	}
+
+	// chunks arrive out of order so the part can only be hashed once it's whole
+	return hashFile(ctx, partPath)
+}
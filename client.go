@@ -0,0 +1,216 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TLSSettings configures TLS for connections to the servers of the URLs
+// starting with a prefix
+type TLSSettings struct {
+	// CertFile and KeyFile, if set, are the paths of the PEM encoded client
+	// certificate and private key presented to servers that ask for one
+	CertFile string
+	KeyFile  string
+
+	// CAFiles, if set, are the paths of PEM bundles of the only CAs trusted
+	// to sign server certificates, like a private CA of an on-prem mirror; if
+	// empty, the system's CAs are trusted
+	CAFiles []string
+
+	// PinnedSHA256 are the SHA-256 fingerprints, hex encoded with or without
+	// colons, of certificates of which a server's chain must include one. If
+	// empty, any certificate the trusted CAs verify is accepted.
+	PinnedSHA256 []string
+}
+
+// ClientBuilder builds the clients a fetch uses to download Pkg meta files
+// and parts. It's an alternative to writing an httpClientFactory by hand.
+type ClientBuilder struct {
+	// Timeout bounds each request the fetch doesn't give a timeout of its
+	// own; if zero, 30 seconds
+	Timeout time.Duration
+
+	// TLS configures connections to the servers of the URLs starting with its
+	// keys, the settings of the longest matching prefix winning. Connections
+	// to other servers use the system's CAs without a client certificate.
+	TLS map[string]*TLSSettings
+
+	// Proxy, if set, is the proxy used for every source the builder's
+	// clients reach, Pkg meta files and parts alike. If nil, the proxy is
+	// chosen per the process's environment variables.
+	Proxy *ProxySettings
+}
+
+// prefixTransport is the transport used for the URLs starting with a prefix
+type prefixTransport struct {
+	prefix    string
+	transport http.RoundTripper
+}
+
+// routingTransport hands each request to the transport of the longest prefix
+// of its URL, or to its fallback
+type routingTransport struct {
+	prefixed []prefixTransport
+	fallback http.RoundTripper
+}
+
+func (t *routingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pURL := req.URL.String()
+	for _, prefixed := range t.prefixed {
+		if strings.HasPrefix(pURL, prefixed.prefix) {
+			return prefixed.transport.RoundTrip(req)
+		}
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// newTransport returns a transport configured like http.DefaultTransport
+// with the given proxy and TLS configuration
+func newTransport(proxy func(req *http.Request) (*url.URL, error), tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// parseFingerprint decodes a hex encoded SHA-256 fingerprint
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+	if err != nil {
+		return nil, err
+	} else if len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("Expected a fingerprint of %v bytes, got %v", sha256.Size, len(decoded))
+	}
+	return decoded, nil
+}
+
+// verifyPinned returns a function for tls.Config.VerifyPeerCertificate that
+// requires one of the certificates presented to have one of the given
+// fingerprints
+func verifyPinned(pins [][]byte) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			sum := sha256.Sum256(raw)
+			for _, pin := range pins {
+				if string(sum[:]) == string(pin) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("None of the %v certificates presented by the server matches a pinned fingerprint", len(rawCerts))
+	}
+}
+
+// tlsConfig loads the files the settings name into a TLS configuration
+func (s *TLSSettings) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate %v and key %v. Error: %v", s.CertFile, s.KeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(s.CAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, caFile := range s.CAFiles {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read CA bundle %v. Error: %v", caFile, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in CA bundle %v", caFile)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if len(s.PinnedSHA256) > 0 {
+		var pins [][]byte
+		for _, fingerprint := range s.PinnedSHA256 {
+			pin, err := parseFingerprint(fingerprint)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pinned certificate fingerprint %v. Error: %v", fingerprint, err)
+			}
+			pins = append(pins, pin)
+		}
+		config.VerifyPeerCertificate = verifyPinned(pins)
+	}
+
+	return config, nil
+}
+
+// ClientFactory loads the certificates and keys the builder names and
+// returns a factory of clients suitable for PkgFetch and its siblings. The
+// clients share their connections.
+func (b *ClientBuilder) ClientFactory() (func(overrideTimeoutS *uint) *http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if b.Proxy != nil {
+		var err error
+		if proxy, err = b.Proxy.proxyFunc(); err != nil {
+			return nil, redactError(fmt.Errorf("Unable to configure proxy. Error: %v", err))
+		}
+	}
+
+	routing := &routingTransport{fallback: newTransport(proxy, nil)}
+
+	for prefix, settings := range b.TLS {
+		if settings == nil {
+			continue
+		}
+
+		config, err := settings.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to configure TLS for %v. Error: %v", prefix, err)
+		}
+
+		glog.V(4).Infof("Configured TLS for %v: client certificate %v, CA bundles %v, %v pinned certificates", prefix, settings.CertFile, settings.CAFiles, len(settings.PinnedSHA256))
+		routing.prefixed = append(routing.prefixed, prefixTransport{prefix, newTransport(proxy, config)})
+	}
+
+	sort.Slice(routing.prefixed, func(i, j int) bool {
+		if len(routing.prefixed[i].prefix) != len(routing.prefixed[j].prefix) {
+			return len(routing.prefixed[i].prefix) > len(routing.prefixed[j].prefix)
+		}
+		return routing.prefixed[i].prefix < routing.prefixed[j].prefix
+	})
+
+	timeout := b.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return func(overrideTimeoutS *uint) *http.Client {
+		clientTimeout := timeout
+		if overrideTimeoutS != nil {
+			clientTimeout = time.Duration(*overrideTimeoutS) * time.Second
+		}
+
+		return &http.Client{
+			Transport: routing,
+			Timeout:   clientTimeout,
+		}
+	}, nil
+}
@@ -0,0 +1,168 @@
+// +build unit
+
+package fetch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes the certificate and, if given, its key as PEM files in dir
+func writeCert(t *testing.T, dir string, name string, der []byte, key *ecdsa.PrivateKey) (string, string) {
+	certFile := path.Join(dir, name+".pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	if key == nil {
+		return certFile, ""
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	keyFile := path.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// newClientCA returns a CA and a client certificate signed by it
+func newClientCA(t *testing.T) (*x509.Certificate, []byte, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientKey.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	return ca, clientDER, clientKey
+}
+
+func get(t *testing.T, builder *ClientBuilder, url string) error {
+	factory, err := builder.ClientFactory()
+	assert.Nil(t, err)
+
+	response, err := factory(nil).Get(url)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code %v", response.StatusCode)
+	}
+	return nil
+}
+
+func Test_ClientBuilder_TLS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-client-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	server := httptest.NewTLSServer(ok)
+	defer server.Close()
+
+	serverCA, _ := writeCert(t, tmpDir, "server", server.Certificate().Raw, nil)
+	sum := sha256.Sum256(server.Certificate().Raw)
+	var colons []string
+	for _, b := range sum {
+		colons = append(colons, fmt.Sprintf("%02X", b))
+	}
+	fingerprint := strings.Join(colons, ":")
+
+	// the test server's certificate isn't signed by a system CA
+	assert.NotNil(t, get(t, &ClientBuilder{}, server.URL))
+
+	assert.Nil(t, get(t, &ClientBuilder{TLS: map[string]*TLSSettings{server.URL: {CAFiles: []string{serverCA}}}}, server.URL))
+
+	// pins are checked in addition to the CAs
+	assert.Nil(t, get(t, &ClientBuilder{TLS: map[string]*TLSSettings{server.URL: {CAFiles: []string{serverCA}, PinnedSHA256: []string{fingerprint}}}}, server.URL))
+	wrongPin := strings.Repeat("00", sha256.Size)
+	assert.NotNil(t, get(t, &ClientBuilder{TLS: map[string]*TLSSettings{server.URL: {CAFiles: []string{serverCA}, PinnedSHA256: []string{wrongPin}}}}, server.URL))
+
+	// the settings of the longest prefix apply
+	prefixed := &ClientBuilder{TLS: map[string]*TLSSettings{
+		server.URL:           {CAFiles: []string{serverCA}},
+		server.URL + "/pin/": {CAFiles: []string{serverCA}, PinnedSHA256: []string{wrongPin}},
+	}}
+	assert.Nil(t, get(t, prefixed, server.URL+"/other/pkg.json"))
+	assert.NotNil(t, get(t, prefixed, server.URL+"/pin/pkg.json"))
+
+	// invalid settings are reported when the factory is built
+	for _, settings := range []*TLSSettings{
+		{CAFiles: []string{path.Join(tmpDir, "missing.pem")}},
+		{CertFile: serverCA},
+		{PinnedSHA256: []string{"abc"}},
+	} {
+		_, err := (&ClientBuilder{TLS: map[string]*TLSSettings{server.URL: settings}}).ClientFactory()
+		assert.NotNil(t, err)
+	}
+}
+
+func Test_ClientBuilder_MutualTLS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-client-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ca, clientDER, clientKey := newClientCA(t)
+	clientCert, clientKeyFile := writeCert(t, tmpDir, "client", clientDER, clientKey)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	serverCA, _ := writeCert(t, tmpDir, "server", server.Certificate().Raw, nil)
+
+	assert.NotNil(t, get(t, &ClientBuilder{TLS: map[string]*TLSSettings{server.URL: {CAFiles: []string{serverCA}}}}, server.URL))
+	assert.Nil(t, get(t, &ClientBuilder{TLS: map[string]*TLSSettings{server.URL: {CertFile: clientCert, KeyFile: clientKeyFile, CAFiles: []string{serverCA}}}}, server.URL))
+}
+
+func Test_ClientBuilder_Timeout(t *testing.T) {
+	factory, err := (&ClientBuilder{Timeout: time.Minute}).ClientFactory()
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, time.Minute, factory(nil).Timeout)
+	override := uint(5)
+	assert.EqualValues(t, 5*time.Second, factory(&override).Timeout)
+}
@@ -0,0 +1,140 @@
+// Command horizon-pkg-cache inspects and trims the Pkgs fetched into a
+// destination directory and the part cache used by those fetches.
+//
+// Usage:
+//
+//	horizon-pkg-cache -dir <destination dir> [-cache <part cache dir>] <command> [args]
+//
+// Commands:
+//
+//	list                  list Pkgs, least recently used first
+//	usage                 print the bytes used
+//	pin <pkg ID> [reason] protect a Pkg from eviction
+//	unpin <pkg ID>        make a Pkg subject to eviction again
+//	remove <pkg ID>       remove an unpinned Pkg
+//	gc                    remove content no Pkg references
+//	trim <bytes>          evict least recently used Pkgs until no more than the given bytes are used
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-fetch"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v -dir <destination dir> [-cache <part cache dir>] <list|usage|pin|unpin|remove|gc|trim> [args]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func printReport(report *fetch.CacheReport) {
+	for _, pkgID := range report.Evicted {
+		fmt.Printf("evicted %v\n", pkgID)
+	}
+	for _, removed := range report.Removed {
+		fmt.Printf("removed %v\n", removed)
+	}
+	fmt.Printf("%v bytes used, was %v\n", report.BytesAfter, report.BytesBefore)
+}
+
+func main() {
+	dir := flag.String("dir", "", "the destination directory of Pkg fetches")
+	cacheDir := flag.String("cache", "", "the directory of the part cache used by Pkg fetches, if any")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if *dir == "" || len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var partCache *fetch.PartCache
+	if *cacheDir != "" {
+		partCache = &fetch.PartCache{Dir: *cacheDir}
+	}
+	manager := fetch.NewCacheManager(*dir, partCache)
+
+	arg := func(ix int, name string) string {
+		if len(args) <= ix {
+			fail("Command %v requires argument %v", args[0], name)
+		}
+		return args[ix]
+	}
+
+	switch args[0] {
+	case "list":
+		pkgs, err := manager.Pkgs()
+		if err != nil {
+			fail("Unable to list Pkgs. Error: %v", err)
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "PKG ID\tBYTES\tLAST USED\tPINNED")
+		for _, pkg := range pkgs {
+			pinned := ""
+			if pkg.Pinned {
+				pinned = fmt.Sprintf("yes (%v)", pkg.PinReason)
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", pkg.PkgID, pkg.Bytes, pkg.LastUsed.Format(time.RFC3339), pinned)
+		}
+		writer.Flush()
+
+	case "usage":
+		bytes, err := manager.Usage()
+		if err != nil {
+			fail("Unable to compute usage. Error: %v", err)
+		}
+		fmt.Println(bytes)
+
+	case "pin":
+		if err := manager.Pin(arg(1, "pkg ID"), strings.Join(args[2:], " ")); err != nil {
+			fail("Unable to pin Pkg. Error: %v", err)
+		}
+
+	case "unpin":
+		if err := manager.Unpin(arg(1, "pkg ID")); err != nil {
+			fail("Unable to unpin Pkg. Error: %v", err)
+		}
+
+	case "remove":
+		if err := manager.Remove(arg(1, "pkg ID")); err != nil {
+			fail("Unable to remove Pkg. Error: %v", err)
+		}
+
+	case "gc":
+		report, err := manager.GC()
+		if err != nil {
+			fail("Unable to collect garbage. Error: %v", err)
+		}
+		printReport(report)
+
+	case "trim":
+		quota, err := strconv.ParseInt(arg(1, "bytes"), 10, 64)
+		if err != nil {
+			fail("Illegal quota: %v", args[1])
+		}
+
+		report, err := manager.EnforceQuota(quota)
+		if report != nil {
+			printReport(report)
+		}
+		if err != nil {
+			fail("Unable to meet quota. Error: %v", err)
+		}
+
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
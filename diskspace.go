@@ -0,0 +1,117 @@
+package fetch
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"os"
+	"path"
+	"syscall"
+)
+
+// availableBytes returns the space available to unprivileged users on the
+// file system holding the given directory
+func availableBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// requiredBytes sums the bytes still to be written to pkgDir to fetch the
+// given parts, discounting parts already in place or in the part cache and
+// the content of partial downloads that may be resumed
+func requiredBytes(pkgDir string, parts map[string]horizonpkg.DockerImagePart, options *Options) int64 {
+	var required int64
+	for _, part := range parts {
+		partPath := path.Join(pkgDir, part.ID)
+
+		if info, err := os.Stat(partPath); err == nil && info.Size() == part.Bytes {
+			continue
+		}
+
+		if options.PartCache != nil {
+			if entryPath, err := options.PartCache.EntryPath(part.Sha256sum); err == nil {
+				if info, err := os.Stat(entryPath); err == nil && info.Size() == part.Bytes {
+					continue
+				}
+			}
+		}
+
+		needed := part.Bytes
+		if info, err := os.Stat(tempPartPath(partPath)); err == nil && info.Size() < part.Bytes {
+			needed -= info.Size()
+		}
+		required += needed
+	}
+
+	return required
+}
+
+// precheckDiskSpace fails if the file system holding pkgDir doesn't have room
+// for the given parts plus the options' reserve
+func precheckDiskSpace(pkgDir string, parts map[string]horizonpkg.DockerImagePart, options *Options) error {
+	if options.SkipDiskSpaceCheck {
+		return nil
+	}
+
+	required := requiredBytes(pkgDir, parts, options) + options.DiskSpaceReserve
+	if required == 0 {
+		return nil
+	}
+
+	available, err := availableBytes(pkgDir)
+	if err != nil {
+		// not every platform or file system can tell; the fetch goes ahead and fails later if it must
+		glog.Errorf("Unable to determine free space available in %v, skipping check. Error: %v", pkgDir, err)
+		return nil
+	}
+
+	glog.V(3).Infof("Fetch into %v requires %v bytes including a reserve of %v bytes, %v bytes are available", pkgDir, required, options.DiskSpaceReserve, available)
+	if required > available {
+		return fetcherrors.PkgInsufficientSpaceError{
+			Msg:            fmt.Sprintf("Insufficient space on file system of %v to fetch Pkg", pkgDir),
+			RequiredBytes:  required,
+			AvailableBytes: available,
+		}
+	}
+
+	return nil
+}
+
+// precheckBundleSpace fails if the file system holding destinationDir
+// doesn't have room for the content of the bundle archive at the given path
+// twice over, as extracted and as copied into place by the fetch, plus the
+// options' reserve. The usual check before parts are downloaded follows the
+// extraction.
+func precheckBundleSpace(archivePath string, destinationDir string, options *Options) error {
+	if options.SkipDiskSpaceCheck {
+		return nil
+	}
+
+	extracted, err := bundleArchiveBytes(archivePath)
+	if err != nil {
+		return fetcherrors.PkgSourceError{fmt.Sprintf("Unable to read bundle %v", archivePath), err}
+	}
+
+	available, err := availableBytes(destinationDir)
+	if err != nil {
+		glog.Errorf("Unable to determine free space available in %v, skipping check. Error: %v", destinationDir, err)
+		return nil
+	}
+
+	required := 2*extracted + options.DiskSpaceReserve
+	glog.V(3).Infof("Fetch from bundle %v into %v requires %v bytes including a reserve of %v bytes, %v bytes are available", archivePath, destinationDir, required, options.DiskSpaceReserve, available)
+	if required > available {
+		return fetcherrors.PkgInsufficientSpaceError{
+			Msg:            fmt.Sprintf("Insufficient space on file system of %v to extract and fetch from bundle %v", destinationDir, archivePath),
+			RequiredBytes:  required,
+			AvailableBytes: available,
+		}
+	}
+
+	return nil
+}
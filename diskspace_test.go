@@ -0,0 +1,48 @@
+// +build unit
+
+package fetch
+
+import (
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_RequiredBytes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-diskspace-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cache, err := NewPartCache(path.Join(tmpDir, "cache"), LinkHard)
+	assert.Nil(t, err)
+
+	sum := func(c string) string { return strings.Repeat(c, 64) }
+	parts := map[string]horizonpkg.DockerImagePart{
+		"fetched:1":   {ID: "fetched", Sha256sum: sum("a"), Bytes: 100},
+		"partial:1":   {ID: "partial", Sha256sum: sum("b"), Bytes: 100},
+		"cached:1":    {ID: "cached", Sha256sum: sum("c"), Bytes: 100},
+		"needed:1":    {ID: "needed", Sha256sum: sum("d"), Bytes: 100},
+		"wrongsize:1": {ID: "wrongsize", Sha256sum: sum("e"), Bytes: 100},
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(tmpDir, "fetched"), make([]byte, 100), 0600))
+	assert.Nil(t, ioutil.WriteFile(tempPartPath(path.Join(tmpDir, "partial")), make([]byte, 40), 0600))
+	assert.Nil(t, ioutil.WriteFile(path.Join(cache.Dir, sum("c")), make([]byte, 100), 0600))
+	assert.Nil(t, ioutil.WriteFile(path.Join(tmpDir, "wrongsize"), make([]byte, 10), 0600))
+
+	assert.EqualValues(t, 60+100+100+100, requiredBytes(tmpDir, parts, &Options{}))
+	assert.EqualValues(t, 60+100+100, requiredBytes(tmpDir, parts, &Options{PartCache: cache}))
+
+	// the reserve can't be met
+	err = precheckDiskSpace(tmpDir, parts, &Options{DiskSpaceReserve: 1 << 62})
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.NotContains(t, err.Error(), "InternalError")
+	}
+	assert.Nil(t, precheckDiskSpace(tmpDir, parts, &Options{DiskSpaceReserve: 1 << 62, SkipDiskSpaceCheck: true}))
+	assert.Nil(t, precheckDiskSpace(tmpDir, parts, &Options{}))
+}
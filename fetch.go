@@ -1,13 +1,14 @@
 package fetch
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
 	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
-	"github.com/open-horizon/rsapss-tool/verify"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -17,89 +18,112 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
-func authenticatedRequest(pURL string, authCreds map[string]map[string]string) (*http.Request, error) {
+// authenticatedRequest returns a GET request of the given URL with the
+// credentials of the authenticator configured for the longest prefix of it
+func authenticatedRequest(ctx context.Context, pURL string, auth authenticators) (*http.Request, error) {
 	req, err := http.NewRequest(http.MethodGet, pURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
-	// matching them (for now) amounts to first prefix match wins
-	for k, v := range authCreds {
-		if strings.HasPrefix(pURL, k) {
-
-			var username string
-			if val, ok := v["username"]; ok {
-				username = val
-			}
-
-			var password string
-			if val, ok := v["password"]; ok {
-				password = val
-			}
-
-			if username != "" && password != "" {
-				glog.V(3).Infof("Using username %v in HTTPS Basic auth header to %v", username, pURL)
-				req.SetBasicAuth(username, password)
-				break
-			}
+	if match := auth.match(pURL); match != nil {
+		glog.V(3).Infof("Using %T configured for prefix %v to authenticate request to %v", match.authenticator, Redact(match.prefix), Redact(pURL))
+		if err := match.authenticator.Authenticate(req); err != nil {
+			return nil, fmt.Errorf("Unable to authenticate request to %v. Error: %v", pURL, err)
 		}
 	}
 
 	return req, nil
 }
 
-// side effect: stores the pkgMeta file in destinationDir
-func fetchPkgMeta(client *http.Client, authCreds map[string]map[string]string, keyFiles []string, pkgURL string, pkgURLSignature string, destinationDir string) (*horizonpkg.Pkg, error) {
-	writeFile := func(destinationDir string, fileName string, content []byte) (string, error) {
-		destFilePath := path.Join(destinationDir, fileName)
-		// this'll overwrite
-		if err := ioutil.WriteFile(destFilePath, content, 0600); err != nil {
-			return "", fetcherrors.PkgMetaError{fmt.Sprintf("Failed to write file %v", destFilePath), err}
+// fetchPkgMeta fetches and verifies the Pkg meta file, returning it along
+// with the validators of the response for lockPkgMeta to store in
+// destinationDir; they make the next fetch of it from the same URL
+// conditional. That next fetch only gets here if the manifest of a complete
+// fetch didn't satisfy it first, as after an interrupted fetch or removal of
+// parts; a manifest is trusted without a request since the meta file it
+// names is verified by the given signature anyway.
+func fetchPkgMeta(ctx context.Context, client *http.Client, auth authenticators, keyFiles []string, pkgURL string, pkgURLSignature string, destinationDir string) (*horizonpkg.Pkg, *pkgMeta, error) {
+	request := func(validators *metaValidators) (*http.Response, error) {
+		glog.V(5).Infof("Fetching Pkg from %v", Redact(pkgURL))
+
+		req, err := authenticatedRequest(ctx, pkgURL, auth)
+		if err != nil {
+			return nil, err
 		}
+		validators.apply(req)
 
-		return destFilePath, nil
+		response, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, canceledError(ctx, fmt.Sprintf("Fetch of Pkg meta from %v canceled", pkgURL))
+			}
+			return nil, err
+		}
+		return response, nil
 	}
 
-	glog.V(5).Infof("Fetching Pkg from %v", pkgURL)
+	// a meta file fetched before is only downloaded again if it's changed
+	validators := readMetaValidators(destinationDir, pkgURL)
 
-	req, err := authenticatedRequest(pkgURL, authCreds)
+	// fetch, hydrate
+	response, err := request(validators)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer func() { response.Body.Close() }()
 
-	// fetch, hydrate
-	response, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if response.StatusCode == http.StatusNotModified && validators != nil {
+		pkg, rawMeta, err := readLocalPkgMeta(destinationDir, validators.pkgID, pkgURLSignature, keyFiles)
+		if err == nil {
+			glog.V(3).Infof("Pkg meta at %v not modified, using local copy", Redact(pkgURL))
+			return pkg, &pkgMeta{pkgURL: pkgURL, raw: rawMeta}, nil
+		}
+
+		glog.Errorf("Pkg meta at %v not modified but local copy is unusable, fetching it again. Error: %v", Redact(pkgURL), err)
+		response.Body.Close()
+		refetched, err := request(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		response = refetched
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fetcherrors.PkgMetaError{fmt.Sprintf("Unexpected status code in response to Horizon Pkg fetch: %v", response.StatusCode), fmt.Errorf("Failed to fetch Pkg meta from %v", pkgURL)}
+		return nil, nil, fetcherrors.PkgMetaError{fmt.Sprintf("Unexpected status code in response to Horizon Pkg fetch: %v", response.StatusCode), fmt.Errorf("Failed to fetch Pkg meta from %v", pkgURL)}
 	}
-	defer response.Body.Close()
 	rawBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, fetcherrors.PkgMetaError{"Failed to read Pkg meta", err}
+	}
 
-	if err := verifySignatureWithAnyKey(keyFiles, rawBody, []string{pkgURLSignature}); err != nil {
-
-		return nil, fetcherrors.PkgMetaError{fmt.Sprintf("Pkg metadata failed cryptographic verification: %v", err), fmt.Errorf("Failure processing Pkg meta: %v and signature: %v", pkgURL, pkgURLSignature)}
+	pkg, err := verifyPkgMeta(rawBody, pkgURLSignature, keyFiles)
+	if err != nil {
+		return nil, nil, fetcherrors.PkgMetaError{fmt.Sprintf("Pkg metadata failed verification: %v", err), fmt.Errorf("Failure processing Pkg meta: %v and signature: %v", pkgURL, pkgURLSignature)}
 	}
 
-	var pkg horizonpkg.Pkg
-	if err := json.Unmarshal(rawBody, &pkg); err != nil {
+	// TODO: dump all pkg content (both meta and parts) to debug
+
+	return pkg, &pkgMeta{pkgURL: pkgURL, raw: rawBody, validators: newMetaValidators(pkgURL, response.Header)}, nil
+}
+
+// verifyPkgMeta checks the Pkg meta content against its signature and
+// deserializes it
+func verifyPkgMeta(rawMeta []byte, pkgURLSignature string, keyFiles []string) (*horizonpkg.Pkg, error) {
+	digest := sha256.Sum256(rawMeta)
+	if _, err := verifySignatures(keyFiles, digest[:], []string{pkgURLSignature}, DefaultTrustPolicy()); err != nil {
 		return nil, err
 	}
 
-	fetchFilePath, err := writeFile(destinationDir, fmt.Sprintf("%v.json", pkg.ID), rawBody)
-	if err != nil {
+	var pkg horizonpkg.Pkg
+	if err := json.Unmarshal(rawMeta, &pkg); err != nil {
 		return nil, err
 	}
 
-	glog.V(2).Infof("Wrote PkgMeta to %v", fetchFilePath)
-
-	// TODO: dump all pkg content (both meta and parts) to debug
-
 	return &pkg, nil
 }
 
@@ -119,6 +143,17 @@ func precheckPkgParts(pkg *horizonpkg.Pkg) (map[string]horizonpkg.DockerImagePar
 	return partsMap, nil
 }
 
+// hashMismatchError indicates that a downloaded part's content doesn't match
+// its expected hash; unlike a signature failure, this might be remedied by
+// fetching the part again
+type hashMismatchError struct {
+	partPath string
+}
+
+func (e hashMismatchError) Error() string {
+	return fmt.Sprintf("Part failed verification: %v", e.partPath)
+}
+
 // VerificationError extends error, indicating a problem verifying a Pkg part
 type VerificationError struct {
 	msg string
@@ -138,6 +173,13 @@ func (r fetchErrRecorder) String() string {
 	return fmt.Sprintf("Errors: %v", r.Errors)
 }
 
+// Count returns the number of errors recorded so far
+func (r fetchErrRecorder) Count() int {
+	r.WriteLock.Lock()
+	defer r.WriteLock.Unlock()
+	return len(r.Errors)
+}
+
 func newFetchErrRecorder() fetchErrRecorder {
 	return fetchErrRecorder{
 		Errors:    make(map[string]error),
@@ -148,208 +190,542 @@ func newFetchErrRecorder() fetchErrRecorder {
 type partFetchFailure struct {
 	HTTPStatusCode int
 	PartURL        string
+	Err            error // a network or transfer error, if there was one
+}
+
+// sourcesFailedError is the internal error of a part that couldn't be fetched
+// from any of its sources. It carries the last failure so that the retry
+// policy can judge whether fetching the whole part again is worthwhile.
+type sourcesFailedError struct {
+	msg     string
+	failure *partFetchFailure // nil if no source was tried
+}
+
+func (e sourcesFailedError) Error() string {
+	return e.msg
+}
+
+const (
+	// resumeSuffix is appended to a part's path to name the file that records
+	// how a partially-downloaded part can be resumed
+	resumeSuffix = ".resume"
+)
+
+// partResumeState records the source and validator (an ETag or Last-Modified
+// value) of the response that produced a partial part file. It's only written
+// if the source advertised support for byte range requests.
+type partResumeState struct {
+	URL       string `json:"url"`
+	Validator string `json:"validator"`
 }
 
-func fetchPkgPart(client *http.Client, authCreds map[string]map[string]string, pkgURLBase string, partPath string, expectedBytes int64, sources []horizonpkg.PartSource) error {
-	tryOpen := func(path string) (*os.File, error) {
-		return os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+func readResumeState(partPath string) *partResumeState {
+	raw, err := ioutil.ReadFile(partPath + resumeSuffix)
+	if err != nil {
+		return nil
 	}
 
-	tryRemove := func(f *os.File, msg string) error {
-		glog.Error(msg)
+	var state partResumeState
+	if err := json.Unmarshal(raw, &state); err != nil || state.URL == "" || state.Validator == "" {
+		glog.Errorf("Ignoring unusable resume state for part %v. Error: %v", partPath, err)
+		return nil
+	}
 
-		f.Close()
-		err := os.Remove(f.Name())
-		if err != nil {
+	return &state
+}
+
+func writeResumeState(partPath string, pURL string, response *http.Response) {
+	removeResumeState(partPath)
+
+	if !strings.Contains(strings.ToLower(response.Header.Get("Accept-Ranges")), "bytes") {
+		return
+	}
+
+	// a strong ETag is preferred; Last-Modified is acceptable to If-Range too
+	validator := response.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = response.Header.Get("Last-Modified")
+	}
+
+	if validator == "" {
+		return
+	}
+
+	serial, err := json.Marshal(partResumeState{URL: pURL, Validator: validator})
+	if err == nil {
+		err = ioutil.WriteFile(partPath+resumeSuffix, serial, 0600)
+	}
+
+	if err != nil {
+		glog.Errorf("Failed to write resume state for part %v, a failed download of it will not be resumable. Error: %v", partPath, err)
+	}
+}
+
+func removeResumeState(partPath string) {
+	if err := os.Remove(partPath + resumeSuffix); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Failed to remove resume state for part %v. Error: %v", partPath, err)
+	}
+}
+
+// contentRangeStart returns the first byte position in a Content-Range
+// response header value like "bytes 200-1000/1001"
+func contentRangeStart(contentRange string) (int64, error) {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, fmt.Errorf("Unparseable Content-Range header value: %v. Error: %v", contentRange, err)
+	}
+
+	return start, nil
+}
+
+// canceledError wraps the reason the given context ended in the error type
+// returned from all canceled operations
+func canceledError(ctx context.Context, msg string) error {
+	return fetcherrors.PkgFetchCanceledError{msg, ctx.Err()}
+}
+
+// contextReader is an io.Reader that fails reads once its context is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// fetchPkgPartFromSource attempts to download the part from a single source
+// URL, resuming from partFile's current content if a previous download from
+// the same source left resume state behind. If the server ignores the range
+// request (or the content changed since the partial download) the part is
+// downloaded in full. The download is subject to the options' bandwidth and
+// per-host connection limits. The returned bool indicates whether the part
+// file is complete.
+func fetchPkgPartFromSource(ctx context.Context, client *http.Client, auth authenticators, pURL string, partFile *os.File, expectedBytes int64, options *Options, progress *partProgress, hasher hash.Hash) (complete bool, failure *partFetchFailure, err error) {
+	partPath := partFile.Name()
+
+	truncate := func() error {
+		hasher.Reset()
+		progress.downloaded(0)
+		removeResumeState(partPath)
+		if err := partFile.Truncate(0); err != nil {
 			return err
 		}
+		_, err := partFile.Seek(0, io.SeekStart)
+		return err
+	}
 
-		return nil
+	info, err := partFile.Stat()
+	if err != nil {
+		return false, nil, err
 	}
 
-	var partFile *os.File
-	var openErr error
-	partFile, openErr = tryOpen(partPath)
+	offset := info.Size()
+	resume := readResumeState(partPath)
+	if offset > 0 && (resume == nil || resume.URL != pURL) {
+		glog.V(3).Infof("Part file %v is incomplete (%v bytes and should be %v bytes) and can't be resumed from %v. Discarding its content", partPath, offset, expectedBytes, Redact(pURL))
+		if err := truncate(); err != nil {
+			return false, nil, err
+		}
+		offset = 0
+	}
 
-	if openErr != nil && os.IsExist(openErr) {
+	req, err := authenticatedRequest(ctx, pURL, auth)
+	if err != nil {
+		return false, nil, err
+	}
 
-		info, statErr := os.Stat(partPath)
-		if statErr != nil {
-			err := tryRemove(partFile, fmt.Sprintf("Error getting status for file %v although it exists. Will attempt to delete it and continue", partPath))
-			if err != nil {
-				return err
+	if offset > 0 {
+		glog.V(3).Infof("Attempting to resume download of part %v at byte %v from %v", partPath, offset, Redact(pURL))
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", resume.Validator)
+	}
+
+	if options.HostConnections != nil {
+		release, ok := options.HostConnections.acquire(ctx, req.URL.Host)
+		if !ok {
+			return false, nil, ctx.Err()
+		}
+		defer release()
+	}
+
+	request := options.SourceHealth.request(req.URL.Host)
+	defer func() { request.done(ctx, complete, failure) }()
+
+	// fetch, hydrate
+	response, err := client.Do(req)
+	if err != nil {
+		glog.Errorf("Failed to download part %v (using url %v). Error: %v", partPath, Redact(pURL), redactError(err))
+		return false, &partFetchFailure{0, pURL, err}, nil
+	}
+	defer response.Body.Close()
+	request.response()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(response.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			glog.Errorf("Server responded to range request for part %v with unexpected content range (%v). Will discard partial content. Error: %v", partPath, response.Header.Get("Content-Range"), err)
+			if err := truncate(); err != nil {
+				return false, nil, err
 			}
+			return false, &partFetchFailure{response.StatusCode, pURL, fmt.Errorf("Unexpected Content-Range in response: %v", response.Header.Get("Content-Range"))}, nil
+		}
 
-		} else if info.Size() == expectedBytes {
-			glog.V(3).Infof("Part file %v exists on disk and it has the appropriate size, skipping redownload", partPath)
-			return nil
-		} else {
-			// TODO: can try resume here if we have an HTTP server that knows how to handle it
-			err := tryRemove(partFile, fmt.Sprintf("Part file %v exists on disk but it's not complete (%v bytes and should be %v bytes). Deleting it and trying again", partPath, info.Size(), expectedBytes))
-			if err != nil {
-				return err
+		// content already on disk has to be hashed before the rest of it is
+		hasher.Reset()
+		if _, err := partFile.Seek(0, io.SeekStart); err != nil {
+			return false, nil, err
+		}
+
+		if _, err := io.CopyN(hasher, contextReader{ctx, partFile}, offset); err != nil {
+			return false, nil, fmt.Errorf("Unable to hash existing content of part %v. Error: %v", partPath, err)
+		}
+
+	case http.StatusOK:
+		if offset > 0 {
+			glog.V(3).Infof("Server did not honor range request for part %v, downloading it in full", partPath)
+		}
+
+		if err := truncate(); err != nil {
+			return false, nil, err
+		}
+		offset = 0
+		writeResumeState(partPath, pURL, response)
+
+	default:
+		if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// don't try resume from this content again
+			if err := truncate(); err != nil {
+				return false, nil, err
 			}
 		}
+
+		glog.Errorf("Failed to download part %v (using url %v). Response status: %v", partPath, Redact(pURL), response.Status)
+		return false, &partFetchFailure{response.StatusCode, pURL, nil}, nil
+	}
+
+	var body io.Reader = response.Body
+	if options.Bandwidth != nil {
+		body = throttledReader{ctx, options.Bandwidth, body}
+	}
+
+	progress.downloaded(offset)
+	// the part's content is hashed as it's written so that it needn't be read again for verification
+	bytes, err := io.Copy(io.MultiWriter(&progressWriter{partFile, progress, offset}, hasher), body)
+	request.bytes = bytes
+	if err != nil {
+		// the partial content is retained so that a later attempt can resume
+		glog.Errorf("IO copy from HTTP response body failed on part: %v (%v of %v bytes written). Error: %v", partPath, offset+bytes, expectedBytes, redactError(err))
+		return false, &partFetchFailure{response.StatusCode, pURL, err}, nil
+	}
+
+	if offset+bytes != expectedBytes {
+		glog.Errorf("Error in download and copy of part %v (using url %v): wrote %v bytes but expected %v", partPath, Redact(pURL), offset+bytes, expectedBytes)
+		if err := truncate(); err != nil {
+			return false, nil, err
+		}
+		return false, &partFetchFailure{response.StatusCode, pURL, fmt.Errorf("Wrote %v bytes but expected %v", offset+bytes, expectedBytes)}, nil
+	}
+
+	removeResumeState(partPath)
+	return true, nil, nil
+}
+
+// hashFile computes the SHA-256 digest of the file at the given path,
+// streaming its content
+func hashFile(ctx context.Context, filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, contextReader{ctx, file}); err != nil {
+		if ctx.Err() != nil {
+			return nil, canceledError(ctx, fmt.Sprintf("Hashing of file %v canceled", filePath))
+		}
+		return nil, fmt.Errorf("Unable to copy file content into hash function for %v. Error: %v", filePath, err)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// fetchPkgPart downloads the part to a temporary file next to partPath,
+// trying each source in turn and retrying each per the options' RetryPolicy.
+// Large parts are first tried in chunks per the options' ChunkPolicy.
+// The given state identifies the attempt at fetching the whole part and
+// accumulates records of each download attempt. It returns the SHA-256 digest
+// of the part's content and the path of the file holding it: the temporary
+// file which is to be renamed to partPath once verified or partPath itself if
+// the part was already in place.
+func fetchPkgPart(ctx context.Context, client *http.Client, auth authenticators, pkgURL *url.URL, partPath string, expectedBytes int64, sources []horizonpkg.PartSource, options *Options, state *partFetch) ([]byte, string, error) {
+	progress := state.progress
+
+	tempPath := tempPartPath(partPath)
+
+	if info, err := os.Stat(partPath); err == nil {
+		if info.Size() == expectedBytes {
+			glog.V(3).Infof("Part file %v exists on disk and it has the appropriate size, skipping redownload", partPath)
+			progress.downloaded(expectedBytes)
+			digest, err := hashFile(ctx, partPath)
+			return digest, partPath, err
+		}
+
+		// parts are only ever renamed into place complete so this one's been tampered with
+		glog.Errorf("Part file %v exists on disk but it's the wrong size (%v bytes and should be %v bytes). Deleting it and trying again", partPath, info.Size(), expectedBytes)
+		if err := os.Remove(partPath); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if info, err := os.Stat(tempPath); err == nil && info.Size() > expectedBytes {
+		glog.Errorf("Temporary part file %v is larger than expected (%v bytes and should be %v bytes). Deleting it and trying again", tempPath, info.Size(), expectedBytes)
+		removeResumeState(tempPath)
+		if err := os.Remove(tempPath); err != nil {
+			return nil, "", err
+		}
+	}
+
+	partFile, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	defer partFile.Close()
+
+	hasher := sha256.New()
+
+	// a canceled fetch doesn't leave partial content behind
+	discardCanceled := func() ([]byte, string, error) {
 		partFile.Close()
-		partFile, openErr = tryOpen(partPath)
-		if openErr != nil {
-			return openErr
+		removeResumeState(tempPath)
+		if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Failed to remove part %v after canceled fetch. Error: %v", tempPath, err)
 		}
+		return nil, "", canceledError(ctx, fmt.Sprintf("Fetch of part %v canceled", partPath))
 	}
 
-	var fetchFailure *partFetchFailure
+	urls := options.SourceHealth.order(resolveSourceURLs(pkgURL, sources), expectedBytes)
+
+	// a chunked download is only tried afresh: a partial download is resumed
+	// instead and a part that failed its hash check is fetched again in a
+	// single stream in case its sources disagree
+	if info, err := partFile.Stat(); err == nil && info.Size() == 0 && len(urls) > 0 && state.attempt == 1 && options.ChunkPolicy.applies(expectedBytes) {
+		progress.source(urls[0])
+		digest, err := fetchPkgPartChunked(ctx, client, auth, partFile, expectedBytes, urls, options, state)
+		if ctx.Err() != nil {
+			return discardCanceled()
+		} else if err == nil {
+			glog.V(2).Infof("Successfully wrote %v in chunks", tempPath)
+			return digest, tempPath, nil
+		}
 
-	// we are clean, try download
-	for _, source := range sources {
-		var pURL string
-		if strings.HasPrefix(source.URL, "/") {
-			// it's an absolute path but we need to prepend the Pkg's domain, it's assumed by convention
-			pURL = fmt.Sprintf("%s%s", pkgURLBase, source.URL)
-			glog.V(3).Infof("Part has absolute URL path but assumes domain by convention. Composed full URL %v using domain from Pkg URL", pURL)
-		} else {
-			pURL = source.URL
+		glog.Errorf("Chunked download of part %v failed, falling back to a single stream. Error: %v", partPath, redactError(err))
+		state.sourceURL = ""
+		if err := partFile.Truncate(0); err != nil {
+			return nil, "", err
 		}
+	}
 
-		fetchFailure = nil
+	var fetchFailure *partFetchFailure
+	var attempts []FetchAttempt
 
-		req, err := authenticatedRequest(pURL, authCreds)
-		if err != nil {
-			return err
+	policy := options.RetryPolicy
+
+	for _, pURL := range urls {
+		if ctx.Err() != nil {
+			return discardCanceled()
 		}
 
-		// fetch, hydrate
-		response, err := client.Do(req)
-		if err != nil || response.StatusCode != http.StatusOK {
-			glog.Errorf("Failed to download part %v from %v (using url %v). Response: %v. Error: %v", partPath, source, pURL, response, err)
-			fetchFailure = &partFetchFailure{response.StatusCode, pURL}
-		} else {
-			defer response.Body.Close()
-			bytes, err := io.Copy(partFile, response.Body)
-			if err != nil {
-				return fmt.Errorf("IO copy from HTTP response body failed on part: %v. Error: %v", partPath, err)
-			}
+		progress.source(pURL)
 
-			if bytes != expectedBytes {
-				glog.Errorf("Error in download and copy of part %v from %v (using url %v)", partPath, source, pURL)
+		for sourceAttempt := 1; sourceAttempt <= policy.maxAttempts(); sourceAttempt++ {
+			attempt := FetchAttempt{
+				PartID:        path.Base(partPath),
+				URL:           pURL,
+				PartAttempt:   state.attempt,
+				SourceAttempt: sourceAttempt,
+				StartedAt:     time.Now(),
+			}
 
-				// ignore error, give it another shot
-				tryRemove(partFile, fmt.Sprintf("Error in download and copy of part %v from %v (using url %v)", partPath, source, pURL))
+			complete, failure, err := fetchPkgPartFromSource(ctx, client, auth, pURL, partFile, expectedBytes, options, progress, hasher)
+			attempt.Duration = time.Since(attempt.StartedAt)
+
+			if ctx.Err() != nil {
+				attempt.Err = ctx.Err()
+				state.record(options, attempt)
+				return discardCanceled()
+			} else if err != nil {
+				attempt.Err = err
+				state.record(options, attempt)
+				return nil, "", err
+			}
 
-				partFile, openErr = tryOpen(partPath)
-				if openErr != nil {
-					return openErr
+			if complete {
+				state.record(options, attempt)
+				state.sourceURL = pURL
+				if err := partFile.Sync(); err != nil {
+					return nil, "", fmt.Errorf("Unable to sync part %v to disk. Error: %v", tempPath, err)
 				}
-				defer partFile.Close()
-				continue
-			} else {
-				glog.V(2).Infof("Successfully wrote %v", partPath)
-				return nil
+
+				glog.V(2).Infof("Successfully wrote %v", tempPath)
+				return hasher.Sum(nil), tempPath, nil
+			}
+
+			fetchFailure = failure
+			attempt.HTTPStatusCode = failure.HTTPStatusCode
+			attempt.Err = failure.Err
+			if attempt.Err == nil {
+				attempt.Err = fmt.Errorf("Unexpected HTTP status code: %v", failure.HTTPStatusCode)
+			}
+
+			retry := sourceAttempt < policy.maxAttempts() && policy.retryable(failure)
+			if retry {
+				attempt.Backoff = policy.Backoff(sourceAttempt)
+			}
+			state.record(options, attempt)
+			attempts = append(attempts, attempt)
+
+			if !retry {
+				break
+			}
+
+			glog.V(3).Infof("Retrying download of part %v from %v in %v", partPath, Redact(pURL), attempt.Backoff)
+			if !sleep(ctx, attempt.Backoff) {
+				return discardCanceled()
 			}
 		}
 	}
 
-	internalError := fmt.Errorf("Part could not be fetched: %v from any of its sources: %v", partPath, sources)
+	internalError := sourcesFailedError{fmt.Sprintf("Part could not be fetched: %v from any of its sources: %v. Attempts: %v", partPath, sources, attempts), fetchFailure}
 
 	// if this isn't nil, we failed on at least the most recent source and report it
 	if fetchFailure != nil {
 		if fetchFailure.HTTPStatusCode == 401 || fetchFailure.HTTPStatusCode == 403 {
-			return fetcherrors.PkgSourceFetchAuthError{fmt.Sprintf("Authentication or Authorization error attempting to fetch part from URL: %v. HTTP Status code: %v", fetchFailure.PartURL, fetchFailure.HTTPStatusCode), internalError}
+			return nil, "", fetcherrors.PkgSourceFetchAuthError{fmt.Sprintf("Authentication or Authorization error attempting to fetch part from URL: %v. HTTP Status code: %v", fetchFailure.PartURL, fetchFailure.HTTPStatusCode), internalError}
 		}
 
-		return fetcherrors.PkgSourceFetchError{fmt.Sprintf("Error when fetching part from URL: %v. HTTP Status code: %v", fetchFailure.PartURL, fetchFailure.HTTPStatusCode), internalError}
+		return nil, "", fetcherrors.PkgSourceFetchError{fmt.Sprintf("Error when fetching part from URL: %v. HTTP Status code: %v", fetchFailure.PartURL, fetchFailure.HTTPStatusCode), internalError}
 	}
 
 	// try fetching a part from each source, if all fail exit with error
-	return fetcherrors.PkgSourceFetchError{fmt.Sprintf("Failed to complete fetch."), internalError}
+	return nil, "", fetcherrors.PkgSourceFetchError{fmt.Sprintf("Failed to complete fetch."), internalError}
 }
 
-// all provided signatures must match given keys
-func verifyPkgPart(keyFiles []string, partPath string, partHash string, signatures []string) error {
+// verifyPkgPart checks the digest of the part's content, computed as it was
+// written, against the expected hash and the part's signatures per the given
+// trust policy. It returns the names of the key files that verified the
+// signatures.
+func verifyPkgPart(keyFiles []string, partPath string, partHash string, digest []byte, signatures []string, policy *TrustPolicy) ([]string, error) {
 
 	glog.V(5).Infof("Verifying pkg part %v with key files  %v and signatures %v", partPath, keyFiles, signatures)
 
-	partFile, err := os.Open(partPath)
-	if err != nil {
-		return err
-	}
-	defer partFile.Close()
-
-	// Read the file content into the hash function.
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, partFile); err != nil {
-		return fmt.Errorf("Unable to copy image file content into hash function for part %v. Error: %v", partPath, err)
-	}
-
 	// check the hash first
-	actualHash := fmt.Sprintf("%x", string(hasher.Sum(nil)))
+	actualHash := fmt.Sprintf("%x", digest)
 	if partHash != actualHash {
 		// delete file too
-		partFile.Close()
+		removeResumeState(partPath)
 		err := os.Remove(partPath)
 		if err != nil {
 			glog.Errorf("Failed to remove part %v after failed hash check. Error: %v", partPath, err)
 		}
-		return fetcherrors.PkgSignatureVerificationError{fmt.Sprintf("Mismatch between expected hash, %v and actual hash %v.", partHash, actualHash), fmt.Errorf("Part failed verification: %v", partPath)}
+		return nil, fetcherrors.PkgSignatureVerificationError{fmt.Sprintf("Mismatch between expected hash, %v and actual hash %v.", partHash, actualHash), hashMismatchError{partPath}}
 	}
 
-	data, err := ioutil.ReadFile(partPath)
-	if err != nil {
-		return err
+	verifiedBy, err := verifySignatures(keyFiles, digest, signatures, policy)
+	if err == nil {
+		glog.V(5).Infof("Part %v verified by keys in %v", partPath, verifiedBy)
+		return verifiedBy, nil
 	}
 
-	if err := verifySignatureWithAnyKey(keyFiles, data, signatures); err == nil {
-		// verified
-		return nil
-	}
+	return nil, fetcherrors.PkgSignatureVerificationError{fmt.Sprintf("Part failed cryptographic verification: %v", err), fmt.Errorf("Part failed verification: %v", partPath)}
+}
 
-	return fetcherrors.PkgSignatureVerificationError{fmt.Sprintf("Part failed cryptographic verification: %v", err), fmt.Errorf("Part failed verification: %v", partPath)}
+// partRetryable decides if a failure to fetch or verify a whole part warrants
+// fetching it again: a hash mismatch does, as does a failure of its sources
+// the retry policy would retry
+func partRetryable(err error, policy *RetryPolicy) bool {
+	switch err := err.(type) {
+	case fetcherrors.PkgSourceFetchError:
+		return sourcesRetryable(err.InternalError, policy)
+	case fetcherrors.PkgSourceFetchAuthError:
+		return sourcesRetryable(err.InternalError, policy)
+	case fetcherrors.PkgSignatureVerificationError:
+		_, mismatch := err.InternalError.(hashMismatchError)
+		return mismatch
+	default:
+		return false
+	}
 }
 
-func verifySignatureWithAnyKey(keyFiles []string, data []byte, signatures []string) error {
+// sourcesRetryable applies the retry policy to the last failure of a part's
+// sources; if no source was tried, as when all were skipped for their
+// health, a later attempt may fare better
+func sourcesRetryable(err error, policy *RetryPolicy) bool {
+	failed, ok := err.(sourcesFailedError)
+	if !ok || failed.failure == nil {
+		return true
+	}
+	return policy.retryable(failed.failure)
+}
 
-	// this is computationally expensive
-	for _, sig := range signatures {
-		// TODO: refactor this code, extract verification into rsapss-tool; for efficiency, perhaps we should give keys IDs and include those in the pkg signature
-		glog.V(7).Infof("Verifying with sig: %v, key files: %v", sig, keyFiles)
+// partsToSkip asks the given skip part function, if any, which of the parts
+// are already available and needn't be fetched. It returns the repotags of
+// those parts.
+func partsToSkip(skipPartFetchFn *func(repotag string) (bool, error), partsMap map[string]horizonpkg.DockerImagePart) map[string]bool {
+	skipped := make(map[string]bool, 0)
+	if skipPartFetchFn == nil {
+		return skipped
+	}
 
-		if verified, _, failedMap := verify.InputVerifiedByAnyKey(keyFiles, sig, data); !verified {
-			return fmt.Errorf("Error verifying signature: %v for data: %v, Error: %v", sig, string(data), failedMap)
+	for repotag := range partsMap {
+		skip, err := (*skipPartFetchFn)(repotag)
+		if err != nil {
+			glog.Errorf("Check with provided skip part function failed with error: %v. Proceeding with fetch", err)
+		} else if skip {
+			glog.V(3).Infof("Skipping fetch of %v because provided skip part function reported the part was already available", repotag)
+			skipped[repotag] = true
 		}
-
-		return nil
 	}
 
-	return VerificationError{}
+	return skipped
 }
 
-func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipPartFetchFn *func(repotag string) (bool, error), authCreds map[string]map[string]string, pkgURLBase string, partsMap map[string]horizonpkg.DockerImagePart, destinationDir string, keyFiles []string) (map[string]string, error) {
+func fetchAndVerify(ctx context.Context, httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipped map[string]bool, auth authenticators, pkgURL *url.URL, partsMap map[string]horizonpkg.DockerImagePart, destinationDir string, keyFiles []string, options *Options, tracker *progressTracker) (map[string]PartResult, error) {
 	fetchErrs := newFetchErrRecorder()
-	// a mapping of docker image repotag to abs path
-	fetched := make(map[string]string, 0)
+	// a mapping of docker image repotag to a record of the fetched part
+	fetched := make(map[string]PartResult, 0)
 
-	addResult := func(id string, repotag string, err error, partPath *string) {
+	addResult := func(id string, repotag string, err error, record *PartResult) {
 		fetchErrs.WriteLock.Lock()
 		defer fetchErrs.WriteLock.Unlock()
 
 		if err != nil {
-			// record failures
+			// record failures, without the credentials of their sources' URLs
+			err = redactError(err)
 
 			glog.V(6).Infof("Recording fetch error: %v with key: %v", err, id)
 			fetchErrs.Errors[id] = err
-		} else if partPath != nil {
+		} else if record != nil {
 			// success
 
-			if *partPath == "" {
-				// indicates a skipped fetch, a success
-				fetched[repotag] = ""
+			if record.Skipped {
+				// a skipped fetch, a success
+				fetched[repotag] = *record
 			} else {
 				// indicates a succesful fetch
 				var abs string
-				abs, err = filepath.Abs(*partPath)
+				abs, err = filepath.Abs(record.Path)
 				if err != nil {
 					fetchErrs.Errors[id] = err
 				} else {
-					fetched[repotag] = abs
+					record.Path = abs
+					fetched[repotag] = *record
 				}
 			}
 		}
@@ -357,18 +733,25 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 
 	var group sync.WaitGroup
 
+	// bounds the number of parts downloaded at once; nil if unbounded
+	var slots chan struct{}
+	concurrentParts := len(partsMap)
+	if options.MaxConcurrentParts > 0 {
+		slots = make(chan struct{}, options.MaxConcurrentParts)
+		if options.MaxConcurrentParts < concurrentParts {
+			concurrentParts = options.MaxConcurrentParts
+		}
+	}
+
 	for repotag, part := range partsMap {
-		if skipPartFetchFn != nil {
-			skip, err := (*skipPartFetchFn)(repotag)
-			if err != nil {
-				glog.Errorf("Check with provided skip part function failed with error: %v. Proceeding with fetch", err)
-			} else if skip {
-				glog.V(3).Infof("Skipping fetch of %v because provided skip part function reported the part was already available", repotag)
-				// an empty string
-				empty := ""
-				addResult(part.ID, repotag, nil, &empty)
-				continue
-			}
+		if ctx.Err() != nil {
+			break
+		}
+
+		if skipped[repotag] {
+			addResult(part.ID, repotag, nil, &PartResult{Repotag: repotag, PartID: part.ID, Bytes: part.Bytes, Sha256sum: part.Sha256sum, Skipped: true})
+			tracker.part(repotag, part).skipped()
+			continue
 		}
 
 		group.Add(1)
@@ -377,6 +760,26 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 		go func(repotag string, part horizonpkg.DockerImagePart) {
 			defer group.Done()
 
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// another fetch of the part has either finished it, which is
+			// reused, or left a partial download, which is resumed
+			partLock, err := acquireLock(ctx, lockPath(destinationDir, part.ID), true, options.lockTimeout())
+			if err != nil {
+				if ctx.Err() == nil {
+					addResult(part.ID, repotag, err, nil)
+				}
+				return
+			}
+			defer partLock.release()
+
 			// we don't care about file extensions if they're not in the ID
 			partPath := path.Join(destinationDir, part.ID)
 
@@ -389,13 +792,98 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 				timeoutS = uint((part.Bytes * 8) / 1024 / 100)
 			}
 
-			glog.V(2).Infof("Fetching %v", part.ID)
-			addResult(part.ID, repotag, fetchPkgPart(httpClientFactory(&timeoutS), authCreds, pkgURLBase, partPath, part.Bytes, part.Sources), nil)
+			if options.Bandwidth != nil && options.Bandwidth.BytesPerSecond() > 0 {
+				// allow for this Pkg's concurrent downloads to share the bandwidth evenly, and then some
+				throttledS := uint(2*part.Bytes*int64(concurrentParts)/options.Bandwidth.BytesPerSecond()) + 120
+				if throttledS > timeoutS {
+					timeoutS = throttledS
+				}
+			}
+
+			started := time.Now()
+			progress := tracker.part(repotag, part)
+			progress.started()
+
+			// a part in the cache is linked into place and verified like one already on disk
+			var cached bool
+			if options.PartCache != nil {
+				linked, err := options.PartCache.link(part.Sha256sum, part.Bytes, partPath)
+				if err != nil {
+					glog.Errorf("Unable to use part cache for part %v. Error: %v", part.ID, err)
+				} else if linked {
+					glog.V(3).Infof("Linked part %v from the part cache", part.ID)
+					cached = true
+				}
+			}
+
+			state := &partFetch{progress: progress}
+			policy := options.RetryPolicy
+			for partAttempt := 1; ; partAttempt++ {
+				state.attempt = partAttempt
+
+				glog.V(2).Infof("Fetching %v", part.ID)
+				digest, contentPath, err := fetchPkgPart(ctx, httpClientFactory(&timeoutS), auth, pkgURL, partPath, part.Bytes, part.Sources, options, state)
+
+				if err == nil && fetchErrs.Count() == 0 && ctx.Err() == nil {
+					glog.V(2).Infof("Verifying %v", part.ID)
+					progress.verifying()
+					var verifiedBy []string
+					verifiedBy, err = verifyPkgPart(keyFiles, contentPath, part.Sha256sum, digest, part.Signatures, options.TrustPolicy)
+					if err == nil && contentPath != partPath {
+						err = commitPart(contentPath, partPath)
+					}
+
+					if err == nil && options.PartCache != nil && !cached {
+						if err := options.PartCache.store(partPath, part.Sha256sum); err != nil {
+							glog.Errorf("Unable to add part %v to the part cache. Error: %v", part.ID, err)
+						}
+					}
+
+					if err == nil {
+						addResult(part.ID, repotag, nil, &PartResult{
+							Repotag:    repotag,
+							PartID:     part.ID,
+							Path:       partPath,
+							Bytes:      part.Bytes,
+							Sha256sum:  part.Sha256sum,
+							SourceURL:  state.sourceURL,
+							Cached:     cached,
+							Duration:   time.Since(started),
+							Attempts:   state.attempts,
+							VerifiedAt: time.Now(),
+							VerifiedBy: verifiedBy,
+						})
+						progress.verified()
+						return
+					}
+				}
+
+				if cached && err != nil && partRetryable(err, policy) {
+					// the cache entry is no good, the part has to be downloaded
+					glog.Errorf("Part %v linked from the part cache failed verification, evicting it", part.ID)
+					if err := options.PartCache.evict(part.Sha256sum); err != nil {
+						glog.Errorf("Unable to evict part %v from the part cache. Error: %v", part.ID, err)
+					}
+					cached = false
+				}
+
+				if err == nil || partAttempt >= policy.maxPartAttempts() || !partRetryable(err, policy) || fetchErrs.Count() != 0 {
+					// neither the caller nor the progress observer gets the
+					// credentials of the sources' URLs
+					err = redactError(err)
+					addResult(part.ID, repotag, err, nil)
+					if err != nil {
+						progress.failed(err)
+					}
+					return
+				}
 
-			// TODO: support retries here
-			if len(fetchErrs.Errors) == 0 {
-				glog.V(2).Infof("Verifying %v", part)
-				addResult(part.ID, repotag, verifyPkgPart(keyFiles, partPath, part.Sha256sum, part.Signatures), &partPath)
+				backoff := policy.Backoff(partAttempt)
+				glog.Errorf("Failed to fetch part %v, will try again in %v. Error: %v", part.ID, backoff, redactError(err))
+				if !sleep(ctx, backoff) {
+					progress.failed(redactError(canceledError(ctx, fmt.Sprintf("Fetch of part %v canceled", partPath))))
+					return
+				}
 			}
 
 		}(repotag, part)
@@ -403,6 +891,10 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 
 	group.Wait()
 
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx, fmt.Sprintf("Fetch of parts canceled. Errors: %v", &fetchErrs))
+	}
+
 	if len(fetchErrs.Errors) > 0 {
 		return nil, fmt.Errorf("Error fetching parts. Errors: %v", &fetchErrs)
 	}
@@ -411,9 +903,42 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 }
 
 // PkgFetch fetches a pkg metadata file from the given URL and then verifies
-// the content of the pkg.
+// the content of the pkg. It returns a mapping of docker image repotag to the
+// absolute path of the part providing it; see PkgFetchWithResult for more
+// detail.
 //     pkgURL is the URL of the pkg file containing the image content
+//     authCreds maps URL prefixes to a "username" and "password" used for
+//       Basic auth of requests of URLs with the prefix; see
+//       Options.Authenticators for other schemes
 func PkgFetch(httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipPartFetchFn *func(repotag string) (bool, error), pkgURL url.URL, pkgURLSignature string, destinationDir string, keyFiles []string, authCreds map[string]map[string]string) (map[string]string, error) {
+	return PkgFetchContext(context.Background(), httpClientFactory, skipPartFetchFn, pkgURL, pkgURLSignature, destinationDir, keyFiles, authCreds, nil)
+}
+
+// PkgFetchContext is like PkgFetch but aborts in-flight downloads and pending
+// verification of parts when the given context is canceled. Partially
+// downloaded parts are removed and an error of type
+// fetcherrors.PkgFetchCanceledError is returned in that case. The given
+// options may be nil to use defaults.
+func PkgFetchContext(ctx context.Context, httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipPartFetchFn *func(repotag string) (bool, error), pkgURL url.URL, pkgURLSignature string, destinationDir string, keyFiles []string, authCreds map[string]map[string]string, options *Options) (map[string]string, error) {
+	result, err := PkgFetchWithResult(ctx, httpClientFactory, skipPartFetchFn, pkgURL, pkgURLSignature, destinationDir, keyFiles, authCreds, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.ImagePaths(), nil
+}
+
+// PkgFetchWithResult is like PkgFetchContext but returns a FetchResult
+// describing the fetched Pkg and each of its parts. Credentials in URLs and
+// headers are scrubbed from the errors it returns; see Redact.
+func PkgFetchWithResult(ctx context.Context, httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipPartFetchFn *func(repotag string) (bool, error), pkgURL url.URL, pkgURLSignature string, destinationDir string, keyFiles []string, authCreds map[string]map[string]string, options *Options) (*FetchResult, error) {
+	result, err := pkgFetchWithResult(ctx, httpClientFactory, skipPartFetchFn, pkgURL, pkgURLSignature, destinationDir, keyFiles, authCreds, options)
+	return result, redactError(err)
+}
+
+func pkgFetchWithResult(ctx context.Context, httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipPartFetchFn *func(repotag string) (bool, error), pkgURL url.URL, pkgURLSignature string, destinationDir string, keyFiles []string, authCreds map[string]map[string]string, options *Options) (*FetchResult, error) {
+	options = options.withDefaults()
+
 	mkdirs := func(pp string) error {
 		if err := os.MkdirAll(pp, 0700); err != nil {
 			return err
@@ -421,22 +946,52 @@ func PkgFetch(httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipP
 		return nil
 	}
 
+	// Pkgs and their parts may be served from the file system as well
+	httpClientFactory = withFileSources(httpClientFactory)
+	auth := newAuthenticators(authCreds, options.Authenticators)
 	client := httpClientFactory(nil)
 
 	if pkgURLSignature == "" {
 		return nil, fmt.Errorf("Disabling Pkg file signature checking not supported")
 	}
 
+	// a previous successful fetch of the same Pkg needn't be repeated, nor its
+	// meta file revalidated
+	if pkg, manifest, err := fetchFromManifest(ctx, pkgURL.String(), pkgURLSignature, destinationDir, keyFiles, options); err == nil {
+		return newFetchResultFromManifest(pkg, destinationDir, manifest)
+	} else if ctx.Err() != nil {
+		return nil, canceledError(ctx, "Fetch canceled while checking manifest of a previous fetch")
+	} else if !os.IsNotExist(err) {
+		glog.V(3).Infof("Unable to use manifest of a previous fetch of %v, will fetch it. Reason: %v", Redact(pkgURL.String()), redactError(err))
+	}
+
 	// make pkg subdirectory in destination directory
 	if err := mkdirs(destinationDir); err != nil {
 		return nil, fetcherrors.PkgSourceError{"Failed creating Pkg destination dirs on host", err}
 	}
 
-	pkg, err := fetchPkgMeta(client, authCreds, keyFiles, pkgURL.String(), pkgURLSignature, destinationDir)
+	pkg, meta, err := fetchPkgMeta(ctx, client, auth, keyFiles, pkgURL.String(), pkgURLSignature, destinationDir)
 	if err != nil {
 		return nil, err
 	}
 
+	// a bundle may name parts by their IDs rather than by their sources
+	if bundle, ok := client.Transport.(*bundleTransport); ok {
+		bundle.usePkg(pkg, &pkgURL)
+	}
+
+	// concurrent fetches of a Pkg share its lock and take turns with each
+	// part; removal of the Pkg from the cache takes it exclusively, as does
+	// writing its meta file
+	pkgLock, err := lockPkgMeta(ctx, destinationDir, pkg.ID, meta, options.lockTimeout())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, canceledError(ctx, fmt.Sprintf("Fetch canceled waiting for lock on Pkg %v", pkg.ID))
+		}
+		return nil, err
+	}
+	defer pkgLock.release()
+
 	// we do this separately so we have a greater chance of the async fetches succeeding before we start them all
 	partsMap, err := precheckPkgParts(pkg)
 	if err != nil {
@@ -448,19 +1003,72 @@ func PkgFetch(httpClientFactory func(overrideTimeoutS *uint) *http.Client, skipP
 		return nil, fetcherrors.PkgSourceError{"Failed creating Pkg destination dirs on host", err}
 	}
 
-	pkgURLParts := strings.Split(pkgURL.String(), "/")
-	pkgURLBase := strings.Join(pkgURLParts[0:len(pkgURLParts)-1], "/")
+	partIDs := make(map[string]bool, 0)
+	for _, part := range partsMap {
+		partIDs[part.ID] = true
+	}
+	sweepStaleTempParts(pkgDestinationDir, partIDs)
+
+	skipped := partsToSkip(skipPartFetchFn, partsMap)
+	needed := make(map[string]horizonpkg.DockerImagePart, 0)
+	for repotag, part := range partsMap {
+		if !skipped[repotag] {
+			needed[repotag] = part
+		}
+	}
+
+	// better to fail now than to run out of space halfway through the download
+	if err := precheckDiskSpace(pkgDestinationDir, needed, options); err != nil {
+		return nil, err
+	}
+
+	parts, err := fetchAndVerify(ctx, httpClientFactory, skipped, auth, &pkgURL, partsMap, pkgDestinationDir, keyFiles, options, newProgressTracker(options.Progress, pkg.ID, partsMap))
+	if err != nil {
+		return nil, err
+	}
 
-	glog.V(4).Infof("Extracted pkgURLBase %v from pkgURL %v", pkgURLBase, pkgURL.String())
+	manifest := &FetchManifest{
+		PkgID:     pkg.ID,
+		PkgURL:    Redact(pkgURL.String()),
+		FetchedAt: time.Now(),
+		Parts:     make(map[string]ManifestPart, 0),
+	}
+	for repotag, part := range parts {
+		manifest.Parts[repotag] = part.manifestPart()
+	}
+
+	// a failure here only costs the next fetch a trip to the network
+	if err := writeFetchManifest(destinationDir, manifest); err != nil {
+		glog.Errorf("Failed to write manifest of Pkg %v. Error: %v", pkg.ID, err)
+	}
 
-	var fetched map[string]string
-	fetched, err = fetchAndVerify(httpClientFactory, skipPartFetchFn, authCreds, pkgURLBase, partsMap, pkgDestinationDir, keyFiles)
+	metaFilePath, err := filepath.Abs(path.Join(destinationDir, fmt.Sprintf("%v.json", pkg.ID)))
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: expand to return the .fetch file; also shortcut some fetch operations if it exists
-	// for now we just return the old-style image files slice
+	return &FetchResult{
+		Pkg:          pkg,
+		MetaFilePath: metaFilePath,
+		Parts:        parts,
+	}, nil
+}
 
-	return fetched, nil
+func newFetchResultFromManifest(pkg *horizonpkg.Pkg, destinationDir string, manifest *FetchManifest) (*FetchResult, error) {
+	metaFilePath, err := filepath.Abs(path.Join(destinationDir, fmt.Sprintf("%v.json", pkg.ID)))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FetchResult{
+		Pkg:          pkg,
+		MetaFilePath: metaFilePath,
+		Parts:        make(map[string]PartResult, 0),
+		FromManifest: true,
+	}
+	for repotag, part := range manifest.Parts {
+		result.Parts[repotag] = part.partResult(repotag)
+	}
+
+	return result, nil
 }
@@ -3,9 +3,14 @@
 package fetch
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
 	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
 	"github.com/open-horizon/rsapss-tool/sign"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +22,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -99,8 +105,41 @@ func Test_PkgFetch_Suite(suite *testing.T) {
 	assert.Nil(suite, err)
 	defer os.RemoveAll(tmpDir)
 
+	// record range requests so resumption can be checked
+	var rangeRequests []string
+	var rangeLock sync.Mutex
+
+	// when set, part requests are handed to this function instead of being served
+	var partHook func(w http.ResponseWriter, r *http.Request)
+	// the number of requests being handled
+	var active int
 	router := mux.NewRouter()
-	router.PathPrefix(urlPath).Handler(http.StripPrefix(urlPath, http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir)))))
+	router.PathPrefix(urlPath).Handler(http.StripPrefix(urlPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeLock.Lock()
+		active++
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			active--
+			rangeLock.Unlock()
+		}()
+
+		if rh := r.Header.Get("Range"); rh != "" {
+			rangeLock.Lock()
+			rangeRequests = append(rangeRequests, rh)
+			rangeLock.Unlock()
+		}
+
+		rangeLock.Lock()
+		hook := partHook
+		rangeLock.Unlock()
+		if hook != nil && strings.HasSuffix(r.URL.Path, ".tgz") {
+			hook(w, r)
+			return
+		}
+
+		http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+	})))
 
 	// serve out of tmpDir, setup will change content of the Pkg to match the ad-hoc server set up here
 	server := httptest.NewServer(router)
@@ -108,6 +147,22 @@ func Test_PkgFetch_Suite(suite *testing.T) {
 
 	pkg := setup(suite, tmpDir, server.URL)
 
+	// quiesce drops client connections and waits for requests being handled
+	// to finish so that requests abandoned by one test don't reach the hooks
+	// of the next
+	quiesce := func() {
+		server.CloseClientConnections()
+		for {
+			rangeLock.Lock()
+			idle := active == 0
+			rangeLock.Unlock()
+			if idle {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
 	destinationDir := path.Join(tmpDir, "destination")
 
 	keysDir, err := filepath.Abs(path.Join(testMaterialDirName, "keys"))
@@ -166,5 +221,1362 @@ func Test_PkgFetch_Suite(suite *testing.T) {
 
 	})
 
+	suite.Run("PkgFetch resumes download of a partial part", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		partID := "ce623bdd773c7527b48a1d9ce7ccd6b6cffee4a6e16849d061bd55c2c455b8fc"
+		partURL := fmt.Sprintf("%s%s/%s/%s.tgz", server.URL, urlPath, pkgID, partID)
+		partPath := path.Join(destinationDir, pkgID, partID)
+		tempPath := tempPartPath(partPath)
+
+		// leave behind the first half of the part and the state a prior, interrupted download would have written
+		resp, err := http.Head(partURL)
+		assert.Nil(t, err)
+		assert.EqualValues(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+		half := pkg.Parts[partID].Bytes / 2
+		assert.Nil(t, os.Rename(partPath, tempPath))
+		assert.Nil(t, os.Truncate(tempPath, half))
+
+		state, err := json.Marshal(partResumeState{URL: partURL, Validator: resp.Header.Get("Last-Modified")})
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(tempPath+resumeSuffix, state, 0600))
+
+		// and an unusable temporary file of a part that isn't in the Pkg
+		strayPath := tempPartPath(path.Join(destinationDir, pkgID, "stray"))
+		assert.Nil(t, ioutil.WriteFile(strayPath, []byte("stray"), 0600))
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		rangeRequests = nil
+		keyfile := filepath.Join(keysDir, "public.pem")
+		pkgs, err := PkgFetch(fakeHTTPClientFactory, nil, *ur, string(sigBytes), destinationDir, []string{keyfile}, emptyAuth)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(pkgs))
+
+		assert.EqualValues(t, []string{fmt.Sprintf("bytes=%d-", half)}, rangeRequests)
+
+		info, err := os.Stat(partPath)
+		assert.Nil(t, err)
+		assert.EqualValues(t, pkg.Parts[partID].Bytes, info.Size())
+
+		for _, leftover := range []string{tempPath, tempPath + resumeSuffix, strayPath} {
+			_, err = os.Stat(leftover)
+			assert.True(t, os.IsNotExist(err))
+		}
+	})
+
+	suite.Run("PkgFetchContext cancels in-flight part downloads and removes partial parts", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// serve some of each part and then stall until the client goes away
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1966305")
+			w.WriteHeader(http.StatusOK)
+			w.Write(make([]byte, 4096))
+			w.(http.Flusher).Flush()
+			cancel()
+			<-r.Context().Done()
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		canceledDir := path.Join(tmpDir, "destination-canceled")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		_, err = PkgFetchContext(ctx, fakeHTTPClientFactory, nil, *ur, string(sigBytes), canceledDir, []string{keyfile}, emptyAuth, nil)
+		assert.NotNil(t, err)
+		assert.IsType(t, fetcherrors.PkgFetchCanceledError{}, err)
+		quiesce()
+
+		for id := range pkg.Parts {
+			_, err := os.Stat(path.Join(canceledDir, pkgID, id))
+			assert.True(t, os.IsNotExist(err))
+
+			_, err = os.Stat(tempPartPath(path.Join(canceledDir, pkgID, id)))
+			assert.True(t, os.IsNotExist(err))
+		}
+	})
+
+	suite.Run("PkgFetchContext retries retryable failures and records attempts", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		// requests abandoned by earlier tests mustn't use up the failures
+		quiesce()
+
+		// each part fails once with a 503 before it's served
+		served := make(map[string]bool)
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			first := !served[r.URL.Path]
+			served[r.URL.Path] = true
+			rangeLock.Unlock()
+
+			if first {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		var attempts []FetchAttempt
+		var attemptsLock sync.Mutex
+		options := &Options{
+			RetryPolicy: &RetryPolicy{
+				MaxAttempts:          2,
+				BaseBackoff:          10 * time.Millisecond,
+				RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+			},
+			OnAttempt: func(attempt FetchAttempt) {
+				attemptsLock.Lock()
+				defer attemptsLock.Unlock()
+				attempts = append(attempts, attempt)
+			},
+		}
+
+		retryDir := path.Join(tmpDir, "destination-retry")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		pkgs, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), retryDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(pkgs))
+
+		// parts are fetched concurrently so their attempts interleave; each
+		// part's own attempts are in order though
+		byPart := make(map[string][]FetchAttempt)
+		for _, attempt := range attempts {
+			byPart[attempt.PartID] = append(byPart[attempt.PartID], attempt)
+		}
+
+		assert.EqualValues(t, len(pkg.Parts), len(byPart))
+		for id, partAttempts := range byPart {
+			if !assert.EqualValues(t, 2, len(partAttempts), "attempts of part %v", id) {
+				continue
+			}
+
+			assert.EqualValues(t, http.StatusServiceUnavailable, partAttempts[0].HTTPStatusCode, "first attempt of part %v", id)
+			assert.NotNil(t, partAttempts[0].Err)
+			assert.Nil(t, partAttempts[1].Err, "second attempt of part %v", id)
+			assert.EqualValues(t, partAttempts[0].URL, partAttempts[1].URL)
+		}
+	})
+
+	suite.Run("PkgFetchContext does not retry authorization failures by default", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		var requests int
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			requests++
+			rangeLock.Unlock()
+			w.WriteHeader(http.StatusForbidden)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		authDir := path.Join(tmpDir, "destination-forbidden")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), authDir, []string{keyfile}, emptyAuth, nil)
+		assert.NotNil(t, err)
+
+		rangeLock.Lock()
+		assert.EqualValues(t, 2, requests)
+		rangeLock.Unlock()
+	})
+
+	suite.Run("PkgFetchContext fetches parts failing with a non-retryable status once", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		requests := make(map[string]int)
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			requests[r.URL.Path]++
+			rangeLock.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		var attempts []FetchAttempt
+		var attemptsLock sync.Mutex
+		options := &Options{
+			RetryPolicy: &RetryPolicy{
+				MaxAttempts:          3,
+				MaxPartAttempts:      3,
+				BaseBackoff:          10 * time.Millisecond,
+				RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+			},
+			OnAttempt: func(attempt FetchAttempt) {
+				attemptsLock.Lock()
+				defer attemptsLock.Unlock()
+				attempts = append(attempts, attempt)
+			},
+		}
+
+		notFoundDir := path.Join(tmpDir, "destination-not-found")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), notFoundDir, []string{keyfile}, emptyAuth, options)
+		assert.NotNil(t, err)
+
+		rangeLock.Lock()
+		for partPath, count := range requests {
+			assert.EqualValues(t, 1, count, partPath)
+		}
+		rangeLock.Unlock()
+
+		attemptsLock.Lock()
+		defer attemptsLock.Unlock()
+		assert.NotEmpty(t, attempts)
+		for _, attempt := range attempts {
+			assert.EqualValues(t, 1, attempt.PartAttempt)
+			assert.EqualValues(t, http.StatusNotFound, attempt.HTTPStatusCode)
+		}
+	})
+
+	suite.Run("PkgFetchContext reports progress of parts and the whole Pkg", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		var events []ProgressEvent
+		options := &Options{
+			Progress: func(event ProgressEvent) {
+				events = append(events, event)
+			},
+		}
+
+		progressDir := path.Join(tmpDir, "destination-progress")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), progressDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+
+		seen := make(map[string][]PartEventType)
+		for _, event := range events {
+			if len(seen[event.PartID]) == 0 || seen[event.PartID][len(seen[event.PartID])-1] != event.Type {
+				seen[event.PartID] = append(seen[event.PartID], event.Type)
+			}
+			assert.True(t, event.PartBytes <= event.PartTotal)
+		}
+
+		for id := range pkg.Parts {
+			assert.EqualValues(t, []PartEventType{PartStarted, PartDownloading, PartVerifying, PartVerified}, seen[id])
+		}
+
+		last := events[len(events)-1].Pkg
+		assert.EqualValues(t, pkgID, last.PkgID)
+		assert.EqualValues(t, 2, last.PartsComplete)
+		assert.EqualValues(t, last.TotalBytes, last.Bytes)
+		assert.EqualValues(t, 100, last.Percent())
+	})
+
+	suite.Run("PkgFetchContext writes a manifest and uses it to skip repeat fetches", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		manifestDir := path.Join(tmpDir, "destination-manifest")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		fetched, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), manifestDir, []string{keyfile}, emptyAuth, nil)
+		assert.Nil(t, err)
+
+		manifest, err := ReadFetchManifest(manifestDir, pkgID)
+		assert.Nil(t, err)
+		assert.EqualValues(t, pkgID, manifest.PkgID)
+		assert.EqualValues(t, 2, len(manifest.Parts))
+		for repotag, record := range manifest.Parts {
+			assert.EqualValues(t, fetched[repotag], record.Path)
+			assert.EqualValues(t, []string{keyfile}, record.VerifiedBy)
+			assert.False(t, record.VerifiedAt.IsZero())
+		}
+
+		// parts are unavailable now so only the manifest can satisfy the fetch
+		var partRequests int
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			partRequests++
+			rangeLock.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		again, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), manifestDir, []string{keyfile}, emptyAuth, &Options{VerifyManifestHashes: true})
+		assert.Nil(t, err)
+		assert.EqualValues(t, fetched, again)
+
+		rangeLock.Lock()
+		assert.Zero(t, partRequests)
+		partHook = nil
+		rangeLock.Unlock()
+
+		// a corrupted part of the right size is caught by rehashing and fetched again
+		corrupt := fetched["alpine:3.5"]
+		info, err := os.Stat(corrupt)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(corrupt, make([]byte, info.Size()), 0600))
+
+		again, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), manifestDir, []string{keyfile}, emptyAuth, &Options{VerifyManifestHashes: true})
+		assert.Nil(t, err)
+		assert.EqualValues(t, fetched, again)
+
+		digest, err := hashFile(context.Background(), corrupt)
+		assert.Nil(t, err)
+		assert.EqualValues(t, path.Base(corrupt), fmt.Sprintf("%x", digest))
+
+		// the manifest isn't used while the Pkg is being removed
+		removal, err := acquireLock(context.Background(), lockPath(manifestDir, pkgID), true, time.Second)
+		assert.Nil(t, err)
+		_, _, err = fetchFromManifest(context.Background(), ur.String(), string(sigBytes), manifestDir, []string{keyfile}, &Options{LockTimeout: 200 * time.Millisecond})
+		assert.IsType(t, fetcherrors.PkgLockTimeoutError{}, err)
+		removal.release()
+
+		_, _, err = fetchFromManifest(context.Background(), ur.String(), string(sigBytes), manifestDir, []string{keyfile}, &Options{})
+		assert.Nil(t, err)
+	})
+
+	suite.Run("PkgFetchWithResult finds the manifest of a Pkg whose URL isn't named after it", func(t *testing.T) {
+		raw, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json", tmpDir, pkgID))
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/srv/latest.json", tmpDir), raw, 0666))
+		defer os.Remove(fmt.Sprintf("%s/srv/latest.json", tmpDir))
+
+		// its credentials mustn't be written to the manifest
+		ur, err := url.Parse(fmt.Sprintf("%s%s/latest.json?token=abc", strings.Replace(server.URL, "://", "://user:hunter2@", 1), urlPath))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		latestDir := path.Join(tmpDir, "destination-latest")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		fetched, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), latestDir, []string{keyfile}, emptyAuth, nil)
+		assert.Nil(t, err)
+		if fetched == nil {
+			return
+		}
+		assert.False(t, fetched.FromManifest)
+
+		manifest, err := ReadFetchManifest(latestDir, pkgID)
+		assert.Nil(t, err)
+		assert.EqualValues(t, Redact(ur.String()), manifest.PkgURL)
+
+		raw, err = ioutil.ReadFile(path.Join(latestDir, pkgID+manifestSuffix))
+		assert.Nil(t, err)
+		assert.NotContains(t, string(raw), "hunter2")
+		assert.NotContains(t, string(raw), "abc")
+
+		// parts are unavailable now so only the manifest can satisfy the fetch
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		again, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), latestDir, []string{keyfile}, emptyAuth, nil)
+		assert.Nil(t, err)
+		if again != nil {
+			assert.True(t, again.FromManifest)
+			assert.EqualValues(t, fetched.ImagePaths(), again.ImagePaths())
+		}
+	})
+
+	suite.Run("PkgFetchWithResult describes the fetched Pkg and its parts", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		resultDir := path.Join(tmpDir, "destination-result")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		result, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), resultDir, []string{keyfile}, emptyAuth, nil)
+		assert.Nil(t, err)
+		assert.False(t, result.FromManifest)
+		assert.EqualValues(t, pkgID, result.Pkg.ID)
+		assert.True(t, filepath.IsAbs(result.MetaFilePath))
+		_, err = os.Stat(result.MetaFilePath)
+		assert.Nil(t, err)
+
+		assert.EqualValues(t, 2, len(result.Parts))
+		for repotag, part := range result.Parts {
+			assert.EqualValues(t, repotag, part.Repotag)
+			assert.EqualValues(t, pkg.Parts[part.PartID].Bytes, part.Bytes)
+			assert.True(t, strings.HasSuffix(part.SourceURL, fmt.Sprintf("%s/%s.tgz", pkgID, part.PartID)))
+			assert.False(t, part.Skipped)
+			assert.True(t, part.Duration > 0)
+			assert.EqualValues(t, 1, len(part.Attempts))
+			assert.Nil(t, part.Attempts[0].Err)
+			assert.EqualValues(t, part.SourceURL, part.Attempts[0].URL)
+			assert.EqualValues(t, []string{keyfile}, part.VerifiedBy)
+
+			info, err := os.Stat(part.Path)
+			assert.Nil(t, err)
+			assert.EqualValues(t, part.Bytes, info.Size())
+		}
+
+		again, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), resultDir, []string{keyfile}, emptyAuth, nil)
+		assert.Nil(t, err)
+		assert.True(t, again.FromManifest)
+		assert.EqualValues(t, result.MetaFilePath, again.MetaFilePath)
+		assert.EqualValues(t, result.ImagePaths(), again.ImagePaths())
+	})
+
+	suite.Run("PkgFetchContext bounds concurrent part downloads", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+
+		var inFlight, maxInFlight int
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			rangeLock.Unlock()
+
+			// hold the connection long enough for downloads to overlap if they would
+			time.Sleep(100 * time.Millisecond)
+			http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+
+			rangeLock.Lock()
+			inFlight--
+			rangeLock.Unlock()
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		for name, options := range map[string]*Options{
+			"parts": &Options{MaxConcurrentParts: 1},
+			"hosts": &Options{HostConnections: NewHostLimiter(1)},
+		} {
+			rangeLock.Lock()
+			maxInFlight = 0
+			rangeLock.Unlock()
+
+			limitDir := path.Join(tmpDir, fmt.Sprintf("destination-limit-%v", name))
+			fetched, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), limitDir, []string{keyfile}, emptyAuth, options)
+			assert.Nil(t, err)
+			assert.EqualValues(t, 2, len(fetched))
+
+			rangeLock.Lock()
+			assert.EqualValues(t, 1, maxInFlight, "limited by %v", name)
+			rangeLock.Unlock()
+		}
+	})
+
+	suite.Run("PkgFetchContext caps download bandwidth", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		var total int64
+		for _, part := range pkg.Parts {
+			total += part.Bytes
+		}
+
+		// the whole Pkg should take about a second
+		options := &Options{Bandwidth: NewBandwidthLimiter(total)}
+
+		bandwidthDir := path.Join(tmpDir, "destination-bandwidth")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		started := time.Now()
+		fetched, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), bandwidthDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(fetched))
+		assert.True(t, time.Since(started) >= 800*time.Millisecond, "fetched in %v", time.Since(started))
+	})
+
+	suite.Run("PkgFetchWithResult downloads large parts in chunks from several sources", func(t *testing.T) {
+		// a mirror serving the same content, recording the ranges requested of it
+		var mirrorRanges []string
+		mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			mirrorRanges = append(mirrorRanges, r.Header.Get("Range"))
+			rangeLock.Unlock()
+			http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+		}))
+		defer mirror.Close()
+
+		mirrored := *pkg
+		mirrored.Parts = make(map[string]horizonpkg.DockerImagePart, 0)
+		for id, part := range pkg.Parts {
+			part.Sources = []horizonpkg.PartSource{
+				{fmt.Sprintf("%s%s/%s/%s.tgz", server.URL, urlPath, pkg.ID, id)},
+				{fmt.Sprintf("%s/%s/%s.tgz", mirror.URL, pkg.ID, id)},
+			}
+			mirrored.Parts[id] = part
+		}
+
+		mirroredBytes, err := json.Marshal(mirrored)
+		assert.Nil(t, err)
+		assert.Nil(t, os.MkdirAll(fmt.Sprintf("%s/srv/mirrored", tmpDir), 0770))
+		assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/srv/mirrored/%s.json", tmpDir, pkgID), mirroredBytes, 0666))
+		mirroredSig, err := sign.Input(fmt.Sprintf("%s/keys/private/private.key", testMaterialDirName), mirroredBytes)
+		assert.Nil(t, err)
+
+		ur, err := url.Parse(fmt.Sprintf("%s%s/mirrored/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		rangeLock.Lock()
+		rangeRequests = nil
+		rangeLock.Unlock()
+
+		options := &Options{ChunkPolicy: &ChunkPolicy{MinPartBytes: 1, ChunkBytes: 256 * 1024, MaxConcurrentChunks: 4}}
+		chunkedDir := path.Join(tmpDir, "destination-chunked")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		result, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, mirroredSig, chunkedDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(result.Parts))
+
+		for _, part := range result.Parts {
+			chunks := int((part.Bytes + 256*1024 - 1) / (256 * 1024))
+			assert.EqualValues(t, chunks, len(part.Attempts))
+			for _, attempt := range part.Attempts {
+				assert.Nil(t, attempt.Err)
+				assert.NotEmpty(t, attempt.Range)
+			}
+
+			digest, err := hashFile(context.Background(), part.Path)
+			assert.Nil(t, err)
+			assert.EqualValues(t, part.Sha256sum, fmt.Sprintf("%x", digest))
+		}
+
+		// both sources served chunks
+		rangeLock.Lock()
+		assert.NotEmpty(t, rangeRequests)
+		assert.NotEmpty(t, mirrorRanges)
+		rangeLock.Unlock()
+	})
+
+	suite.Run("PkgFetchWithResult falls back to a single stream if sources don't support ranges", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("Range")
+			http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		options := &Options{ChunkPolicy: &ChunkPolicy{MinPartBytes: 1, ChunkBytes: 256 * 1024, MaxConcurrentChunks: 4}}
+		fallbackDir := path.Join(tmpDir, "destination-chunked-fallback")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		result, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), fallbackDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(result.Parts))
+
+		for _, part := range result.Parts {
+			last := part.Attempts[len(part.Attempts)-1]
+			assert.Nil(t, last.Err)
+			assert.Empty(t, last.Range)
+			assert.EqualValues(t, http.StatusOK, part.Attempts[0].HTTPStatusCode)
+			assert.NotEmpty(t, part.Attempts[0].Range)
+
+			digest, err := hashFile(context.Background(), part.Path)
+			assert.Nil(t, err)
+			assert.EqualValues(t, part.Sha256sum, fmt.Sprintf("%x", digest))
+		}
+	})
+
+	suite.Run("PkgFetchContext keeps source host statistics", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		serverURL, err := url.Parse(server.URL)
+		assert.Nil(t, err)
+
+		health := NewSourceHealth()
+		health.BreakerThreshold = 1
+		keyfile := filepath.Join(keysDir, "public.pem")
+
+		fetched, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, "destination-health"), []string{keyfile}, emptyAuth, &Options{SourceHealth: health})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(fetched))
+
+		stats := health.Stats()[serverURL.Host]
+		assert.EqualValues(t, 2, stats.Requests)
+		assert.Zero(t, stats.Failures)
+		assert.True(t, stats.Throughput > 0)
+
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		options := &Options{SourceHealth: health, RetryPolicy: &RetryPolicy{MaxAttempts: 1}}
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, "destination-health-broken"), []string{keyfile}, emptyAuth, options)
+		assert.NotNil(t, err)
+
+		stats = health.Stats()[serverURL.Host]
+		assert.True(t, stats.Failures > 0)
+		assert.True(t, stats.CircuitOpen(time.Now()))
+	})
+
+	suite.Run("PkgFetchWithResult links parts from a shared part cache", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+
+		for _, mode := range []LinkMode{LinkHard, LinkSymbolic} {
+			cache, err := NewPartCache(path.Join(tmpDir, fmt.Sprintf("cache-%v", mode)), mode)
+			assert.Nil(t, err)
+			options := &Options{PartCache: cache}
+
+			first, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, fmt.Sprintf("destination-cache-%v-first", mode)), []string{keyfile}, emptyAuth, options)
+			assert.Nil(t, err)
+			for _, part := range first.Parts {
+				assert.False(t, part.Cached)
+			}
+
+			// parts are unavailable now so only the cache can satisfy the fetch
+			var partRequests int
+			rangeLock.Lock()
+			partHook = func(w http.ResponseWriter, r *http.Request) {
+				rangeLock.Lock()
+				partRequests++
+				rangeLock.Unlock()
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			rangeLock.Unlock()
+
+			second, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, fmt.Sprintf("destination-cache-%v-second", mode)), []string{keyfile}, emptyAuth, options)
+
+			rangeLock.Lock()
+			partHook = nil
+			assert.Zero(t, partRequests)
+			rangeLock.Unlock()
+
+			assert.Nil(t, err)
+			for repotag, part := range second.Parts {
+				assert.True(t, part.Cached)
+				assert.NotEqual(t, first.Parts[repotag].Path, part.Path)
+
+				entryPath, err := cache.EntryPath(part.Sha256sum)
+				assert.Nil(t, err)
+				entry, err := os.Stat(entryPath)
+				assert.Nil(t, err)
+
+				for _, fetched := range []string{first.Parts[repotag].Path, part.Path} {
+					linked, err := os.Lstat(fetched)
+					assert.Nil(t, err)
+					assert.EqualValues(t, mode == LinkSymbolic, linked.Mode()&os.ModeSymlink != 0)
+
+					info, err := os.Stat(fetched)
+					assert.Nil(t, err)
+					assert.True(t, os.SameFile(entry, info))
+				}
+			}
+		}
+	})
+
+	suite.Run("PkgFetchWithResult evicts corrupt part cache entries", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+
+		cache, err := NewPartCache(path.Join(tmpDir, "cache-corrupt"), LinkSymbolic)
+		assert.Nil(t, err)
+		options := &Options{PartCache: cache, RetryPolicy: &RetryPolicy{MaxAttempts: 1, MaxPartAttempts: 2}}
+
+		var corrupt string
+		for _, part := range pkg.Parts {
+			entryPath, err := cache.EntryPath(part.Sha256sum)
+			assert.Nil(t, err)
+			assert.Nil(t, ioutil.WriteFile(entryPath, make([]byte, part.Bytes), 0644))
+			corrupt = part.Sha256sum
+			break
+		}
+
+		result, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, "destination-cache-corrupt"), []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		for _, part := range result.Parts {
+			assert.False(t, part.Cached)
+
+			digest, err := hashFile(context.Background(), part.Path)
+			assert.Nil(t, err)
+			assert.EqualValues(t, part.Sha256sum, fmt.Sprintf("%x", digest))
+		}
+
+		// the entry was replaced by the downloaded part
+		entryPath, err := cache.EntryPath(corrupt)
+		assert.Nil(t, err)
+		digest, err := hashFile(context.Background(), entryPath)
+		assert.Nil(t, err)
+		assert.EqualValues(t, corrupt, fmt.Sprintf("%x", digest))
+	})
+
+	suite.Run("PkgFetchContext fails fast without room for the parts", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		var partRequests int
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			partRequests++
+			rangeLock.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+		options := &Options{DiskSpaceReserve: 1 << 62}
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, "destination-full"), []string{keyfile}, emptyAuth, options)
+		assert.NotNil(t, err)
+
+		spaceErr, ok := err.(fetcherrors.PkgInsufficientSpaceError)
+		assert.True(t, ok)
+		assert.True(t, spaceErr.RequiredBytes > spaceErr.AvailableBytes)
+
+		rangeLock.Lock()
+		assert.Zero(t, partRequests)
+		rangeLock.Unlock()
+
+		// parts skipped by the caller don't need room
+		skipAll := func(repotag string) (bool, error) { return true, nil }
+		options = &Options{DiskSpaceReserve: 0}
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, &skipAll, *ur, string(sigBytes), path.Join(tmpDir, "destination-full"), []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+	})
+
+	suite.Run("Concurrent PkgFetchContext calls into one directory download each part once", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		var partRequests int
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			partRequests++
+			rangeLock.Unlock()
+
+			// keep the first fetch busy while the second starts
+			time.Sleep(200 * time.Millisecond)
+			http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		sharedDir := path.Join(tmpDir, "destination-locked")
+		keyfile := filepath.Join(keysDir, "public.pem")
+
+		var group sync.WaitGroup
+		results := make([]map[string]string, 2)
+		for ix := range results {
+			group.Add(1)
+			go func(ix int) {
+				defer group.Done()
+				fetched, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), sharedDir, []string{keyfile}, emptyAuth, nil)
+				assert.Nil(t, err)
+				results[ix] = fetched
+			}(ix)
+		}
+		group.Wait()
+
+		assert.EqualValues(t, 2, len(results[0]))
+		assert.EqualValues(t, results[0], results[1])
+
+		rangeLock.Lock()
+		assert.EqualValues(t, 2, partRequests)
+		rangeLock.Unlock()
+
+		// a Pkg being fetched can't be removed
+		lock, err := tryLock(lockPath(sharedDir, pkgID), false)
+		assert.Nil(t, err)
+		manager := NewCacheManager(sharedDir, nil)
+		assert.NotNil(t, manager.Remove(pkgID))
+		lock.release()
+		assert.Nil(t, manager.Remove(pkgID))
+	})
+
+	suite.Run("PkgFetchContext writes the Pkg meta file with the Pkg lock held exclusively", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		metaLockDir := path.Join(tmpDir, "destination-meta-lock")
+		assert.Nil(t, os.MkdirAll(metaLockDir, 0700))
+		keyfile := filepath.Join(keysDir, "public.pem")
+		options := &Options{LockTimeout: 200 * time.Millisecond}
+
+		// another fetch reading the meta file keeps it from being written
+		reader, err := acquireLock(context.Background(), lockPath(metaLockDir, pkgID), false, time.Second)
+		assert.Nil(t, err)
+		_, err = PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), metaLockDir, []string{keyfile}, emptyAuth, options)
+		assert.IsType(t, fetcherrors.PkgLockTimeoutError{}, err)
+		_, err = os.Stat(path.Join(metaLockDir, pkgID+".json"))
+		assert.True(t, os.IsNotExist(err))
+		reader.release()
+
+		fetched, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), metaLockDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(fetched))
+
+		// a meta file already in place needn't be written, so the fetch goes
+		// ahead beside the reader
+		assert.Nil(t, os.Remove(manifestPath(metaLockDir, pkgID)))
+		reader, err = acquireLock(context.Background(), lockPath(metaLockDir, pkgID), false, time.Second)
+		assert.Nil(t, err)
+		again, err := PkgFetchContext(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), metaLockDir, []string{keyfile}, emptyAuth, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, fetched, again)
+		reader.release()
+
+		// nothing is left of the files written atomically
+		entries, err := ioutil.ReadDir(metaLockDir)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			assert.False(t, strings.HasSuffix(entry.Name(), tempPartSuffix), entry.Name())
+		}
+	})
+
+	suite.Run("PkgFetchBundle fetches from a bundle directory or archive", func(t *testing.T) {
+		bundleDir := path.Join(tmpDir, "bundle")
+		assert.Nil(t, os.MkdirAll(path.Join(bundleDir, pkgID), 0700))
+
+		// the meta file and signature as served and the parts named as in their sources
+		bundleFiles := map[string]string{
+			fmt.Sprintf("%s.json", pkgID):     fmt.Sprintf("%s/srv/%s.json", tmpDir, pkgID),
+			fmt.Sprintf("%s.json.sig", pkgID): fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID),
+		}
+		for id := range pkg.Parts {
+			bundleFiles[fmt.Sprintf("%s/%s.tgz", pkgID, id)] = fmt.Sprintf("%s/%s/%s.tgz", testMaterialDirName, pkgID, id)
+		}
+		for name, src := range bundleFiles {
+			content, err := ioutil.ReadFile(src)
+			assert.Nil(t, err)
+			assert.Nil(t, ioutil.WriteFile(path.Join(bundleDir, name), content, 0600))
+		}
+
+		// and the same as a gzipped tarball
+		archivePath := path.Join(tmpDir, "bundle.tar.gz")
+		archive, err := os.Create(archivePath)
+		assert.Nil(t, err)
+		gz := gzip.NewWriter(archive)
+		tw := tar.NewWriter(gz)
+		for name := range bundleFiles {
+			content, err := ioutil.ReadFile(path.Join(bundleDir, name))
+			assert.Nil(t, err)
+			assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+			_, err = tw.Write(content)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, tw.Close())
+		assert.Nil(t, gz.Close())
+		assert.Nil(t, archive.Close())
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+
+		for name, bundlePath := range map[string]string{"dir": bundleDir, "archive": archivePath} {
+			offlineDir := path.Join(tmpDir, fmt.Sprintf("destination-bundle-%v", name))
+			result, err := PkgFetchBundle(context.Background(), nil, bundlePath, "", offlineDir, []string{keyfile}, nil)
+			assert.Nil(t, err)
+			assert.EqualValues(t, pkgID, result.Pkg.ID)
+			assert.EqualValues(t, 2, len(result.Parts))
+
+			for _, part := range result.Parts {
+				assert.EqualValues(t, path.Join(offlineDir, pkgID, part.PartID), part.Path)
+				assert.EqualValues(t, []string{keyfile}, part.VerifiedBy)
+			}
+
+			// the destination looks like that of a network fetch; only lock files and the manifest are left beside the Pkg
+			infos, err := ioutil.ReadDir(offlineDir)
+			assert.Nil(t, err)
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			assert.ElementsMatch(t, []string{pkgID, pkgID + ".json", pkgID + manifestSuffix, "." + pkgID + lockSuffix}, names)
+
+			manifest, err := ReadFetchManifest(offlineDir, pkgID)
+			assert.Nil(t, err)
+			assert.EqualValues(t, 2, len(manifest.Parts))
+		}
+
+		// extraction counts against the space check, before anything is extracted
+		crampedDir := path.Join(tmpDir, "destination-bundle-cramped")
+		_, err = PkgFetchBundle(context.Background(), nil, archivePath, "", crampedDir, []string{keyfile}, &Options{DiskSpaceReserve: 1 << 62})
+		assert.IsType(t, fetcherrors.PkgInsufficientSpaceError{}, err)
+		extracted, err := filepath.Glob(path.Join(crampedDir, ".bundle-*"))
+		assert.Nil(t, err)
+		assert.Empty(t, extracted)
+
+		// tampered content fails verification
+		meta := path.Join(bundleDir, pkgID+".json")
+		content, err := ioutil.ReadFile(meta)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(meta, append(content, ' '), 0600))
+
+		_, err = PkgFetchBundle(context.Background(), nil, bundleDir, pkgID, path.Join(tmpDir, "destination-bundle-tampered"), []string{keyfile}, nil)
+		assert.IsType(t, fetcherrors.PkgMetaError{}, err)
+	})
+
+	suite.Run("PkgFetchBundle finds parts named by their IDs", func(t *testing.T) {
+		bundleDir := path.Join(tmpDir, "bundle-by-id")
+		assert.Nil(t, os.MkdirAll(path.Join(bundleDir, pkgID), 0700))
+
+		for _, suffix := range []string{".json", ".json.sig"} {
+			content, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s%s", tmpDir, pkgID, suffix))
+			assert.Nil(t, err)
+			assert.Nil(t, ioutil.WriteFile(path.Join(bundleDir, pkgID+suffix), content, 0600))
+		}
+
+		// one part in the Pkg's directory, the other beside the meta file, neither named as in its sources
+		inPkgDir := true
+		for id, part := range pkg.Parts {
+			content, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/%s.tgz", testMaterialDirName, pkgID, id))
+			assert.Nil(t, err)
+
+			name := path.Join(bundleDir, part.ID)
+			if inPkgDir {
+				name = path.Join(bundleDir, pkgID, part.ID)
+				inPkgDir = false
+			}
+			assert.Nil(t, ioutil.WriteFile(name, content, 0600))
+		}
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+		result, err := PkgFetchBundle(context.Background(), nil, bundleDir, pkgID, path.Join(tmpDir, "destination-bundle-by-id"), []string{keyfile}, nil)
+		assert.Nil(t, err)
+		if result != nil {
+			assert.EqualValues(t, 2, len(result.Parts))
+		}
+	})
+
+	suite.Run("PkgFetchBundle serves file:// part sources from the bundle", func(t *testing.T) {
+		// the parts' sources name files that aren't on this host
+		fileSourced := *pkg
+		fileSourced.Parts = make(map[string]horizonpkg.DockerImagePart, 0)
+		for id, part := range pkg.Parts {
+			part.Sources = []horizonpkg.PartSource{{(&url.URL{Scheme: "file", Path: fmt.Sprintf("/nonexistent/%s.tgz", id)}).String()}}
+			fileSourced.Parts[id] = part
+		}
+
+		metaBytes, err := json.Marshal(fileSourced)
+		assert.Nil(t, err)
+		sig, err := sign.Input(fmt.Sprintf("%s/keys/private/private.key", testMaterialDirName), metaBytes)
+		assert.Nil(t, err)
+
+		bundleDir := path.Join(tmpDir, "bundle-file-sourced")
+		assert.Nil(t, os.MkdirAll(path.Join(bundleDir, pkgID), 0700))
+		assert.Nil(t, ioutil.WriteFile(path.Join(bundleDir, pkgID+".json"), metaBytes, 0600))
+		assert.Nil(t, ioutil.WriteFile(path.Join(bundleDir, pkgID+".json.sig"), []byte(sig), 0600))
+		for id := range pkg.Parts {
+			content, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/%s.tgz", testMaterialDirName, pkgID, id))
+			assert.Nil(t, err)
+			assert.Nil(t, ioutil.WriteFile(path.Join(bundleDir, pkgID, id+".tgz"), content, 0600))
+		}
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+		result, err := PkgFetchBundle(context.Background(), nil, bundleDir, pkgID, path.Join(tmpDir, "destination-bundle-file-sourced"), []string{keyfile}, nil)
+		assert.Nil(t, err)
+		if result != nil {
+			assert.EqualValues(t, 2, len(result.Parts))
+		}
+	})
+
+	suite.Run("PkgFetchWithResult resolves relative and file:// part sources", func(t *testing.T) {
+		partDirAbs, err := filepath.Abs(fmt.Sprintf("%s/%s", testMaterialDirName, pkgID))
+		assert.Nil(t, err)
+
+		// one part is found relative to the Pkg, the other on the file system
+		relative := *pkg
+		relative.Parts = make(map[string]horizonpkg.DockerImagePart, 0)
+		var fileSourced bool
+		for id, part := range pkg.Parts {
+			if !fileSourced {
+				part.Sources = []horizonpkg.PartSource{{(&url.URL{Scheme: "file", Path: fmt.Sprintf("%s/%s.tgz", partDirAbs, id)}).String()}}
+				fileSourced = true
+			} else {
+				part.Sources = []horizonpkg.PartSource{{fmt.Sprintf("../%s/%s.tgz", pkgID, id)}}
+			}
+			relative.Parts[id] = part
+		}
+
+		relativeBytes, err := json.Marshal(relative)
+		assert.Nil(t, err)
+		assert.Nil(t, os.MkdirAll(fmt.Sprintf("%s/srv/relative", tmpDir), 0770))
+		relativeMeta := fmt.Sprintf("%s/srv/relative/%s.json", tmpDir, pkgID)
+		assert.Nil(t, ioutil.WriteFile(relativeMeta, relativeBytes, 0666))
+		relativeSig, err := sign.Input(fmt.Sprintf("%s/keys/private/private.key", testMaterialDirName), relativeBytes)
+		assert.Nil(t, err)
+
+		relativeMetaAbs, err := filepath.Abs(relativeMeta)
+		assert.Nil(t, err)
+
+		pkgURLs := map[string]string{
+			"http": fmt.Sprintf("%s%s/relative/%s.json", server.URL, urlPath, pkgID),
+			"file": (&url.URL{Scheme: "file", Path: relativeMetaAbs}).String(),
+		}
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+		for name, pkgURL := range pkgURLs {
+			ur, err := url.Parse(pkgURL)
+			assert.Nil(t, err)
+
+			result, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, relativeSig, path.Join(tmpDir, "destination-relative-"+name), []string{keyfile}, emptyAuth, nil)
+			assert.Nil(t, err)
+			assert.EqualValues(t, 2, len(result.Parts))
+
+			for _, part := range result.Parts {
+				source := relative.Parts[part.PartID].Sources[0].URL
+				if strings.HasPrefix(source, "file:") {
+					assert.EqualValues(t, source, part.SourceURL)
+				} else {
+					// resolved against the Pkg URL, whatever its scheme
+					assert.True(t, strings.HasPrefix(part.SourceURL, ur.Scheme+":"), part.SourceURL)
+					assert.True(t, strings.HasSuffix(part.SourceURL, strings.TrimPrefix(source, "..")), part.SourceURL)
+				}
+
+				digest, err := hashFile(context.Background(), part.Path)
+				assert.Nil(t, err)
+				assert.EqualValues(t, part.Sha256sum, fmt.Sprintf("%x", digest))
+			}
+		}
+	})
+
+	suite.Run("PkgFetchWithResult authenticates with the authenticator of the longest matching prefix", func(t *testing.T) {
+		ur, err := url.Parse(fmt.Sprintf("%s%s/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		var partAuth []string
+		rangeLock.Lock()
+		partHook = func(w http.ResponseWriter, r *http.Request) {
+			rangeLock.Lock()
+			partAuth = append(partAuth, r.Header.Get("Authorization"))
+			rangeLock.Unlock()
+
+			if r.Header.Get("Authorization") != "Bearer part-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+		}
+		rangeLock.Unlock()
+		defer func() {
+			rangeLock.Lock()
+			partHook = nil
+			rangeLock.Unlock()
+		}()
+
+		// the Basic credentials cover the whole server but the token the parts' directory
+		authCreds := map[string]map[string]string{
+			server.URL: {"username": "user", "password": "pass"},
+		}
+		options := &Options{
+			Authenticators: map[string]Authenticator{
+				fmt.Sprintf("%s%s/%s/", server.URL, urlPath, pkgID): &BearerToken{"part-token"},
+			},
+		}
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+		result, err := PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, "destination-authenticators"), []string{keyfile}, authCreds, options)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, len(result.Parts))
+
+		rangeLock.Lock()
+		assert.EqualValues(t, []string{"Bearer part-token", "Bearer part-token"}, partAuth)
+		rangeLock.Unlock()
+
+		// without the token the parts' directory falls under the Basic credentials and is refused
+		_, err = PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), path.Join(tmpDir, "destination-authenticators-basic"), []string{keyfile}, authCreds, nil)
+		assert.NotNil(t, err)
+
+		rangeLock.Lock()
+		assert.Contains(t, partAuth, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+		rangeLock.Unlock()
+	})
+
+	suite.Run("PkgFetchWithResult redacts credentials from errors", func(t *testing.T) {
+		serverURL, err := url.Parse(server.URL)
+		assert.Nil(t, err)
+
+		// sources with credentials in their URLs that can't be fetched
+		secret := *pkg
+		secret.Parts = make(map[string]horizonpkg.DockerImagePart, 0)
+		for id, part := range pkg.Parts {
+			part.Sources = []horizonpkg.PartSource{{fmt.Sprintf("http://user:hunter2@%s%s/missing/%s.tgz?X-Amz-Signature=topsecret", serverURL.Host, urlPath, id)}}
+			secret.Parts[id] = part
+		}
+
+		secretBytes, err := json.Marshal(secret)
+		assert.Nil(t, err)
+		assert.Nil(t, os.MkdirAll(fmt.Sprintf("%s/srv/secret", tmpDir), 0770))
+		assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/srv/secret/%s.json", tmpDir, pkgID), secretBytes, 0666))
+		secretSig, err := sign.Input(fmt.Sprintf("%s/keys/private/private.key", testMaterialDirName), secretBytes)
+		assert.Nil(t, err)
+
+		ur, err := url.Parse(fmt.Sprintf("%s%s/secret/%s.json", server.URL, urlPath, pkgID))
+		assert.Nil(t, err)
+
+		var lock sync.Mutex
+		var attempts []FetchAttempt
+		var failures []error
+		options := &Options{
+			RetryPolicy: &RetryPolicy{MaxAttempts: 1, MaxPartAttempts: 1},
+			OnAttempt: func(attempt FetchAttempt) {
+				lock.Lock()
+				defer lock.Unlock()
+				attempts = append(attempts, attempt)
+			},
+			Progress: func(event ProgressEvent) {
+				if event.Type == PartFailed {
+					lock.Lock()
+					defer lock.Unlock()
+					failures = append(failures, event.Err)
+				}
+			},
+		}
+
+		keyfile := filepath.Join(keysDir, "public.pem")
+		_, err = PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, secretSig, path.Join(tmpDir, "destination-secret"), []string{keyfile}, emptyAuth, options)
+		assert.NotNil(t, err)
+		assert.NotContains(t, err.Error(), "hunter2")
+		assert.NotContains(t, err.Error(), "topsecret")
+		assert.Contains(t, err.Error(), "X-Amz-Signature=REDACTED")
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.NotEmpty(t, attempts)
+		for _, attempt := range attempts {
+			// the URL is the caller's to use but its description is redacted
+			assert.Contains(t, attempt.URL, "topsecret")
+			assert.NotContains(t, attempt.String(), "topsecret")
+			assert.NotContains(t, attempt.String(), "hunter2")
+		}
+
+		assert.EqualValues(t, len(secret.Parts), len(failures))
+		for _, failure := range failures {
+			assert.NotContains(t, failure.Error(), "topsecret")
+			assert.NotContains(t, failure.Error(), "hunter2")
+		}
+	})
+
+	suite.Run("PkgFetchWithResult fetches Pkg meta conditionally", func(t *testing.T) {
+		// serves the Pkg's meta file as latest.json with an ETag, honoring
+		// If-None-Match, and its parts unless they're down
+		var lock sync.Mutex
+		etag := `"v1"`
+		partsDown := true
+		var statuses []int
+		metaServer := httptest.NewServer(http.StripPrefix(urlPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if r.URL.Path != "/latest.json" {
+				if partsDown {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				http.FileServer(http.Dir(fmt.Sprintf("%v/srv", tmpDir))).ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				statuses = append(statuses, http.StatusNotModified)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			statuses = append(statuses, http.StatusOK)
+			http.ServeFile(w, r, fmt.Sprintf("%v/srv/%v.json", tmpDir, pkgID))
+		})))
+		defer metaServer.Close()
+
+		ur, err := url.Parse(fmt.Sprintf("%s%s/latest.json", metaServer.URL, urlPath))
+		assert.Nil(t, err)
+
+		sigBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/srv/%s.json.sig", tmpDir, pkgID))
+		assert.Nil(t, err)
+
+		conditionalDir := path.Join(tmpDir, "destination-conditional")
+		keyfile := filepath.Join(keysDir, "public.pem")
+		metaPath := path.Join(conditionalDir, pkgID+".json")
+
+		fetch := func() (*FetchResult, error) {
+			return PkgFetchWithResult(context.Background(), fakeHTTPClientFactory, nil, *ur, string(sigBytes), conditionalDir, []string{keyfile}, emptyAuth, &Options{RetryPolicy: &RetryPolicy{MaxAttempts: 1}})
+		}
+
+		expectStatuses := func(expected ...int) {
+			lock.Lock()
+			defer lock.Unlock()
+			assert.EqualValues(t, expected, statuses)
+			statuses = nil
+		}
+
+		// an interrupted fetch leaves the meta file and its validators, stored by Pkg ID, but no manifest
+		_, err = fetch()
+		assert.NotNil(t, err)
+		expectStatuses(http.StatusOK)
+
+		raw, err := ioutil.ReadFile(validatorsPath(conditionalDir, pkgID))
+		assert.Nil(t, err)
+		assert.Contains(t, string(raw), `\"v1\"`)
+		_, err = os.Stat(manifestPath(conditionalDir, pkgID))
+		assert.True(t, os.IsNotExist(err))
+
+		metaInfo, err := os.Stat(metaPath)
+		assert.Nil(t, err)
+
+		// resumed, the unchanged local copy is used
+		lock.Lock()
+		partsDown = false
+		lock.Unlock()
+		result, err := fetch()
+		assert.Nil(t, err)
+		expectStatuses(http.StatusNotModified)
+		againInfo, err := os.Stat(metaPath)
+		assert.Nil(t, err)
+		assert.EqualValues(t, metaInfo.ModTime(), againInfo.ModTime())
+
+		// the manifest of a complete fetch satisfies it without any request
+		again, err := fetch()
+		assert.Nil(t, err)
+		if again != nil {
+			assert.True(t, again.FromManifest)
+		}
+		expectStatuses()
+
+		// changed, it's downloaded and the new validators stored
+		lock.Lock()
+		etag = `"v2"`
+		lock.Unlock()
+		if result != nil {
+			assert.Nil(t, os.Remove(result.Parts["alpine:3.5"].Path))
+		}
+		_, err = fetch()
+		assert.Nil(t, err)
+		expectStatuses(http.StatusOK)
+		raw, err = ioutil.ReadFile(validatorsPath(conditionalDir, pkgID))
+		assert.Nil(t, err)
+		assert.Contains(t, string(raw), `\"v2\"`)
+
+		// a local copy that no longer verifies is replaced
+		assert.Nil(t, ioutil.WriteFile(metaPath, []byte("{}"), 0600))
+		_, err = fetch()
+		assert.Nil(t, err)
+		expectStatuses(http.StatusNotModified, http.StatusOK)
+		_, _, err = readLocalPkgMeta(conditionalDir, pkgID, string(sigBytes), []string{keyfile})
+		assert.Nil(t, err)
+
+		// the validators go with the Pkg
+		assert.Nil(t, NewCacheManager(conditionalDir, nil).Remove(pkgID))
+		_, err = os.Stat(validatorsPath(conditionalDir, pkgID))
+		assert.True(t, os.IsNotExist(err))
+	})
+
 	// TODO: expand these cases, test the edges
 }
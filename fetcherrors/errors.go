@@ -80,7 +80,8 @@ func (e PkgSourceError) Error() string {
 
 // PkgSignatureVerificationError indicates a failure to verify a Pkg Part's
 // signature(s). If more than one cryptographic signature is provided for
-// verification, all must match one configured key or verification will fail.
+// verification, all must match one configured key or verification will fail
+// unless the fetch is configured with a more lenient trust policy.
 type PkgSignatureVerificationError struct {
 	Msg           string
 	InternalError error
@@ -91,3 +92,53 @@ type PkgSignatureVerificationError struct {
 func (e PkgSignatureVerificationError) Error() string {
 	return fmt.Sprintf("%v. InternalError: %v", e.Msg, e.InternalError)
 }
+
+// PkgFetchCanceledError indicates that a Pkg fetch was abandoned because the
+// context it was started with was canceled or exceeded its deadline. Partially
+// downloaded parts are removed before this error is returned. The
+// InternalError is the context's error.
+type PkgFetchCanceledError struct {
+	Msg           string
+	InternalError error
+}
+
+// Error provides a loggable error message including the message of an
+// internal error (one enclosed in this error)
+func (e PkgFetchCanceledError) Error() string {
+	return fmt.Sprintf("%v. InternalError: %v", e.Msg, e.InternalError)
+}
+
+// PkgInsufficientSpaceError indicates that the file system of the
+// destination directory doesn't have room for the parts of a Pkg that still
+// have to be downloaded, less the configured reserve. It's returned before
+// any part is downloaded.
+type PkgInsufficientSpaceError struct {
+	Msg            string
+	RequiredBytes  int64 // the bytes needed for parts still to be downloaded plus the reserve
+	AvailableBytes int64 // the bytes available to the fetching process
+	InternalError  error
+}
+
+// Error provides a loggable error message including the message of an
+// internal error (one enclosed in this error), if there is one
+func (e PkgInsufficientSpaceError) Error() string {
+	msg := fmt.Sprintf("%v. Required bytes: %v, available bytes: %v", e.Msg, e.RequiredBytes, e.AvailableBytes)
+	if e.InternalError == nil {
+		return msg
+	}
+	return fmt.Sprintf("%v. InternalError: %v", msg, e.InternalError)
+}
+
+// PkgLockTimeoutError indicates that a fetch gave up waiting for another
+// fetch, possibly in another process, to release its lock on a Pkg or one of
+// its parts in the destination directory.
+type PkgLockTimeoutError struct {
+	Msg           string
+	InternalError error
+}
+
+// Error provides a loggable error message including the message of an
+// internal error (one enclosed in this error)
+func (e PkgLockTimeoutError) Error() string {
+	return fmt.Sprintf("%v. InternalError: %v", e.Msg, e.InternalError)
+}
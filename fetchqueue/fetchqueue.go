@@ -1,13 +1,30 @@
 package fetchqueue
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch"
 	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
 	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	maxCancelationsBuffer = 100
 	maxFetchesBuffer      = 100
+
+	// defaultMaxTries is the number of fetch attempts made for a Task before
+	// it is given up on
+	defaultMaxTries = 3
+
+	// cancelationTTL is the duration after which a cancelation that hasn't
+	// been claimed by its Task is discarded
+	cancelationTTL = 24 * time.Hour
 )
 
 // Pool is a type that specifies the configuration of Tasks.
@@ -16,18 +33,99 @@ type Pool struct {
 	HTTPClientProducer   func(domain string) *http.Client
 	FetchBuffer          chan *Task
 	CancelationBuffer    chan *Cancelation
+	MaxTries             int            // the number of fetch attempts made for each Task before it is abandoned; failed Tasks are tried again after the backoff of FetchOptions' RetryPolicy
+	FetchOptions         *fetch.Options // options for every Task's fetch; may be nil to use defaults. Its bandwidth and host limiters are shared by all Tasks
+
+	lock    sync.Mutex
+	pending map[string]int // the number of Tasks queued or being fetched, by DestinationPath
 }
 
-// EnqueueFetch takes a ??? TODO ???, generates a Task and enqueues it for
-// fetching.
-func (pool *Pool) EnqueueFetch(Task *Task) error {
-	return nil
+// EnqueueFetch takes a Task and enqueues it for fetching. An error is
+// returned if the Task is malformed, if it has been enqueued before or if the
+// fetch buffer is full.
+func (pool *Pool) EnqueueFetch(task *Task) error {
+	if task == nil || task.DestinationPath == "" {
+		return errors.New("Task must be non-nil and specify a DestinationPath")
+	}
+
+	if task.PkgURLSignature == "" {
+		return fmt.Errorf("Task %v is missing a PkgURLSignature", task.DestinationPath)
+	}
+
+	if !atomic.CompareAndSwapInt32(&task.enqueued, 0, 1) {
+		return fmt.Errorf("Task %v has already been enqueued, enqueue a new Task to fetch it again", task.DestinationPath)
+	}
+
+	// counted before it's sent so a worker can't finish it first
+	pool.track(task.DestinationPath)
+
+	select {
+	case pool.FetchBuffer <- task:
+		glog.V(3).Infof("Enqueued fetch Task %v", task.DestinationPath)
+		return nil
+	default:
+		pool.untrack(task.DestinationPath)
+		atomic.StoreInt32(&task.enqueued, 0)
+		return fmt.Errorf("Fetch buffer is full, unable to enqueue Task %v", task.DestinationPath)
+	}
+}
+
+// track counts a Task with the given DestinationPath as queued or being
+// fetched
+func (pool *Pool) track(destinationPath string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.pending == nil {
+		pool.pending = make(map[string]int)
+	}
+	pool.pending[destinationPath]++
+}
+
+// untrack counts a Task with the given DestinationPath as finished and
+// returns the number of Tasks with it still queued or being fetched
+func (pool *Pool) untrack(destinationPath string) int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	count := pool.pending[destinationPath] - 1
+	if count > 0 {
+		pool.pending[destinationPath] = count
+	} else {
+		delete(pool.pending, destinationPath)
+	}
+	return count
+}
+
+// isPending tells whether a Task with the given DestinationPath is queued or
+// being fetched
+func (pool *Pool) isPending(destinationPath string) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return pool.pending[destinationPath] > 0
 }
 
 // CancelFetch takes a cancelation instance and applies it to enqueued
-// Tasks.
+// Tasks. A cancelation matching no Task that's queued or being fetched when
+// it's processed is discarded, so it can't drop a Task enqueued later with
+// the same DestinationPath.
 func (pool *Pool) CancelFetch(fetchCancelation *Cancelation) error {
-	return nil
+	if fetchCancelation == nil || fetchCancelation.DestinationPath == "" {
+		return errors.New("Cancelation must be non-nil and specify a DestinationPath")
+	}
+
+	if fetchCancelation.CancelationRequestSubmittedAt == 0 {
+		fetchCancelation.CancelationRequestSubmittedAt = uint(time.Now().Unix())
+	}
+
+	select {
+	case pool.CancelationBuffer <- fetchCancelation:
+		glog.V(3).Infof("Enqueued cancelation of Task %v", fetchCancelation.DestinationPath)
+		return nil
+	default:
+		return fmt.Errorf("Cancelation buffer is full, unable to enqueue cancelation of Task %v", fetchCancelation.DestinationPath)
+	}
 }
 
 // NewPool configures and returns an instantiation of a Pool or an
@@ -41,6 +139,7 @@ func NewPool(destDir string, clientProducer func(domain string) *http.Client) (*
 		HTTPClientProducer:   clientProducer,
 		FetchBuffer:          make(chan *Task, maxFetchesBuffer),
 		CancelationBuffer:    make(chan *Cancelation, maxCancelationsBuffer),
+		MaxTries:             defaultMaxTries,
 	}
 
 	return pool, nil
@@ -53,19 +152,342 @@ func NewPool(destDir string, clientProducer func(domain string) *http.Client) (*
 // 2. Adding a new Try to the Task's TryHistory w/ success or
 // failure.
 //
-// A Task can be canceled before download (TODO: implement during-fetch
-// cancelation too, later). That amounts to consuming a cancelation message on
-// the cancelation queue and then attaching it to a Task
+// A Task can be canceled before download or during it. That amounts to
+// consuming a cancelation message on the cancelation queue and then attaching
+// it to a Task; a Task that is being fetched when its cancelation arrives has
+// its in-flight downloads aborted.
 type QueueProcessor struct {
+	pool    *Pool
+	workers int
+
+	lock         *sync.Mutex
+	cancelations map[string]*Cancelation       // cancelations of queued or in-flight Tasks, keyed by DestinationPath
+	inFlight     map[string]context.CancelFunc // cancel functions of Tasks being fetched, keyed by DestinationPath
+
+	ctx    context.Context
+	stop   context.CancelFunc
+	active sync.WaitGroup
+}
+
+// NewQueueProcessor returns a QueueProcessor that will consume the given
+// Pool's buffers with the given number of concurrent fetch workers once it is
+// started.
+func NewQueueProcessor(pool *Pool, workers int) (*QueueProcessor, error) {
+	if pool == nil {
+		return nil, errors.New("Pool must be non-nil")
+	}
+
+	if workers < 1 {
+		return nil, fmt.Errorf("Illegal number of workers: %v", workers)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+
+	return &QueueProcessor{
+		pool:         pool,
+		workers:      workers,
+		lock:         &sync.Mutex{},
+		cancelations: make(map[string]*Cancelation),
+		inFlight:     make(map[string]context.CancelFunc),
+		ctx:          ctx,
+		stop:         stop,
+	}, nil
+}
+
+// Start launches the processor's workers and its cancelation consumer. It
+// returns immediately.
+func (p *QueueProcessor) Start() {
+	p.active.Add(1)
+	go p.consumeCancelations()
+
+	for ix := 0; ix < p.workers; ix++ {
+		p.active.Add(1)
+		go p.work()
+	}
+
+	glog.V(2).Infof("Started QueueProcessor with %v workers", p.workers)
+}
+
+// Stop aborts in-flight fetches and waits for all workers to exit. Tasks
+// remaining in the Pool's FetchBuffer are left there.
+func (p *QueueProcessor) Stop() {
+	p.stop()
+	p.active.Wait()
+	glog.V(2).Infof("Stopped QueueProcessor")
+}
+
+func (p *QueueProcessor) consumeCancelations() {
+	defer p.active.Done()
+
+	expiry := time.NewTicker(time.Minute)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+
+		case cancelation := <-p.pool.CancelationBuffer:
+			p.lock.Lock()
+			if !p.pool.isPending(cancelation.DestinationPath) {
+				glog.V(3).Infof("Discarding cancelation of Task %v, it isn't queued or being fetched", cancelation.DestinationPath)
+				p.lock.Unlock()
+				continue
+			}
+
+			p.cancelations[cancelation.DestinationPath] = cancelation
+			if cancel, exists := p.inFlight[cancelation.DestinationPath]; exists {
+				glog.V(3).Infof("Canceling in-flight fetch of Task %v", cancelation.DestinationPath)
+				cancel()
+			}
+			p.lock.Unlock()
+
+		case now := <-expiry.C:
+			p.lock.Lock()
+			for destinationPath, cancelation := range p.cancelations {
+				if now.Sub(time.Unix(int64(cancelation.CancelationRequestSubmittedAt), 0)) > cancelationTTL {
+					glog.V(3).Infof("Expiring unmatched cancelation of Task %v", destinationPath)
+					delete(p.cancelations, destinationPath)
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// claimCancelation removes and returns a pending cancelation for the given
+// Task if one exists
+func (p *QueueProcessor) claimCancelation(task *Task) *Cancelation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cancelation, exists := p.cancelations[task.DestinationPath]
+	if !exists {
+		return nil
+	}
+
+	delete(p.cancelations, task.DestinationPath)
+	return cancelation
+}
+
+func (p *QueueProcessor) work() {
+	defer p.active.Done()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+
+		case task := <-p.pool.FetchBuffer:
+			if task == nil {
+				glog.Errorf("Ignoring nil Task sent to fetch buffer")
+				continue
+			}
+
+			// a Task sent to the buffer directly rather than with
+			// EnqueueFetch is counted once it's received
+			if atomic.CompareAndSwapInt32(&task.enqueued, 0, 1) {
+				p.pool.track(task.DestinationPath)
+			}
+			p.process(task)
+		}
+	}
+}
+
+func (p *QueueProcessor) process(task *Task) {
+	if cancelation := p.claimCancelation(task); cancelation != nil {
+		p.cancel(task, cancelation)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+
+	p.lock.Lock()
+	p.inFlight[task.DestinationPath] = cancel
+	p.lock.Unlock()
+
+	try := Try{
+		FetchStartedAt: int(time.Now().Unix()),
+	}
+
+	result, err := fetch.PkgFetchWithResult(ctx, newDomainClientFactory(p.pool.HTTPClientProducer), task.SkipPartFetchFn, task.PkgURL, task.PkgURLSignature, p.pool.DestinationDirectory, task.KeyFiles, task.AuthCreds, p.pool.FetchOptions)
+
+	p.lock.Lock()
+	delete(p.inFlight, task.DestinationPath)
+	p.lock.Unlock()
+
+	if err != nil {
+		try.FetchErr = err
+		try.FetchMsg = fmt.Sprintf("Fetch of Task %v failed", task.DestinationPath)
+	} else {
+		try.FetchSuccess = true
+		try.FetchMsg = fmt.Sprintf("Fetched Task %v", task.DestinationPath)
+		task.Pkg = result.Pkg
+		task.Fetched = result.ImagePaths()
+	}
+	task.TryHistory = append(task.TryHistory, try)
+
+	glog.V(3).Infof("%v. Error: %v", try.FetchMsg, err)
+
+	if try.FetchSuccess {
+		// a cancelation that arrived too late to matter mustn't match a later Task
+		p.claimCancelation(task)
+		p.finish(task)
+		return
+	}
+
+	if cancelation := p.claimCancelation(task); cancelation != nil {
+		p.cancel(task, cancelation)
+		return
+	}
+
+	if p.ctx.Err() != nil || len(task.TryHistory) >= p.pool.MaxTries {
+		glog.Errorf("Giving up on Task %v after %v tries", task.DestinationPath, len(task.TryHistory))
+		p.finish(task)
+		return
+	}
+
+	// back in line for another try once the backoff has passed, without
+	// holding up the worker; a Task waiting when the processor is stopped is
+	// left in the buffer like any other
+	backoff := p.retryPolicy().Backoff(len(task.TryHistory))
+	glog.V(3).Infof("Trying Task %v again in %v", task.DestinationPath, backoff)
+
+	p.active.Add(1)
+	go func() {
+		defer p.active.Done()
+
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.ctx.Done():
+		}
+
+		select {
+		case p.pool.FetchBuffer <- task:
+		default:
+			glog.Errorf("Fetch buffer is full, unable to requeue Task %v for another try", task.DestinationPath)
+			p.finish(task)
+		}
+	}()
+}
+
+// retryPolicy returns the policy governing the delay before a failed Task is
+// tried again
+func (p *QueueProcessor) retryPolicy() *fetch.RetryPolicy {
+	if p.pool.FetchOptions != nil && p.pool.FetchOptions.RetryPolicy != nil {
+		return p.pool.FetchOptions.RetryPolicy
+	}
+	return fetch.DefaultRetryPolicy()
+}
+
+// finish marks the Task finished and discards a cancelation left for its
+// DestinationPath once no other Task with it is queued or being fetched
+func (p *QueueProcessor) finish(task *Task) {
+	p.lock.Lock()
+	if p.pool.untrack(task.DestinationPath) == 0 {
+		delete(p.cancelations, task.DestinationPath)
+	}
+	p.lock.Unlock()
+
+	task.finish()
+}
+
+func (p *QueueProcessor) cancel(task *Task, cancelation *Cancelation) {
+	cancelation.CanceledOn = uint(time.Now().Unix())
+	task.Cancelation = *cancelation
+	glog.V(3).Infof("Dropped canceled Task %v (canceled by %v)", task.DestinationPath, cancelation.CanceledBy)
+	p.finish(task)
+}
+
+// newDomainClientFactory returns an HTTP client factory suitable for
+// fetch.PkgFetch that sends each request with a client the producer made for
+// the request's domain. Clients are created lazily so each factory (one per
+// fetch attempt) gets fresh ones.
+func newDomainClientFactory(producer func(domain string) *http.Client) func(overrideTimeoutS *uint) *http.Client {
+	transport := &domainTransport{
+		producer: producer,
+		clients:  make(map[string]*http.Client),
+		lock:     &sync.Mutex{},
+	}
+
+	return func(overrideTimeoutS *uint) *http.Client {
+		client := &http.Client{Transport: transport}
+		if overrideTimeoutS != nil {
+			client.Timeout = time.Duration(*overrideTimeoutS) * time.Second
+		}
+		return client
+	}
+}
+
+type domainTransport struct {
+	producer func(domain string) *http.Client
+	clients  map[string]*http.Client
+	lock     *sync.Mutex
+}
+
+func (t *domainTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	client, exists := t.clients[req.URL.Host]
+	if !exists {
+		client = t.producer(req.URL.Host)
+		t.clients[req.URL.Host] = client
+	}
+	t.lock.Unlock()
+
+	if client == nil || client.Transport == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	return client.Transport.RoundTrip(req)
 }
 
 // Task is a job to track fetching a particular fetchable unit by a
-// FetchWorker.
+// FetchWorker. Its fields are written by the QueueProcessor while it is
+// processed; read them only after Done() is closed.
 type Task struct {
 	DestinationPath string // the identifier for the Task
 	Cancelation     Cancelation
 	TryHistory      []Try
 	Pkg             *horizonpkg.Pkg
+
+	PkgURL          url.URL
+	PkgURLSignature string
+	KeyFiles        []string
+	AuthCreds       map[string]map[string]string
+	SkipPartFetchFn *func(repotag string) (bool, error)
+
+	Fetched map[string]string // the result of a successful fetch, a mapping of docker image repotag to abs path
+
+	enqueued int32 // set by EnqueueFetch
+
+	// done is made when first needed, so Tasks sent directly into a Pool's
+	// FetchBuffer work too, and closed once
+	doneInit  sync.Once
+	doneClose sync.Once
+	done      chan struct{}
+}
+
+// Done returns a channel that's closed when the Task is finished: fetched,
+// canceled or abandoned after too many failed tries.
+func (task *Task) Done() <-chan struct{} {
+	return task.doneChan()
+}
+
+func (task *Task) doneChan() chan struct{} {
+	task.doneInit.Do(func() {
+		task.done = make(chan struct{})
+	})
+	return task.done
+}
+
+// finish marks the Task finished, closing its Done() channel
+func (task *Task) finish() {
+	task.doneClose.Do(func() {
+		close(task.doneChan())
+	})
 }
 
 // Try is a historical record of a fetch attempt, either successful or
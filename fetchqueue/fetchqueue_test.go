@@ -0,0 +1,323 @@
+// +build integration
+
+package fetchqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/open-horizon/horizon-pkg-fetch"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"github.com/open-horizon/rsapss-tool/sign"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testMaterialDir = "../test_material"
+	pkgID           = "29ef6969f5cc871153e6a00ec197bb071ce8ceae"
+)
+
+// countingTransport counts the requests sent through it
+type countingTransport struct {
+	lock     sync.Mutex
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	t.requests++
+	t.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (t *countingTransport) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.requests
+}
+
+// serveSignedPkg serves the test material Pkg from a new server, its part
+// sources rewritten to point at the server, and returns the server, the Pkg
+// and the signature of its meta file
+func serveSignedPkg(t *testing.T, tmpDir string) (*httptest.Server, *horizonpkg.Pkg, string) {
+	srvDir := path.Join(tmpDir, "srv")
+	assert.Nil(t, os.MkdirAll(srvDir, 0700))
+	server := httptest.NewServer(http.FileServer(http.Dir(srvDir)))
+
+	raw, err := ioutil.ReadFile(path.Join(testMaterialDir, fmt.Sprintf("%v.json", pkgID)))
+	assert.Nil(t, err)
+
+	var pkg horizonpkg.Pkg
+	assert.Nil(t, json.Unmarshal(raw, &pkg))
+	for id := range pkg.Parts {
+		if strings.HasPrefix(pkg.Parts[id].Sources[0].URL, "http") {
+			pkg.Parts[id].Sources[0] = horizonpkg.PartSource{fmt.Sprintf("%s/%s/%s.tgz", server.URL, pkg.ID, id)}
+		}
+	}
+
+	meta, err := json.Marshal(pkg)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path.Join(srvDir, fmt.Sprintf("%v.json", pkgID)), meta, 0644))
+
+	sig, err := sign.Input(path.Join(testMaterialDir, "keys", "private", "private.key"), meta)
+	assert.Nil(t, err)
+
+	contentDir, err := filepath.Abs(path.Join(testMaterialDir, pkgID))
+	assert.Nil(t, err)
+	assert.Nil(t, os.Symlink(contentDir, path.Join(srvDir, pkgID)))
+
+	return server, &pkg, sig
+}
+
+func Test_QueueProcessor_Suite(suite *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetchqueue-test-")
+	assert.Nil(suite, err)
+	defer os.RemoveAll(tmpDir)
+
+	// every request fails; requests to /stall block until the client goes away
+	var requests int
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+
+		if r.URL.Path == "/stall.json" {
+			<-r.Context().Done()
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	var domains []string
+	producer := func(domain string) *http.Client {
+		lock.Lock()
+		domains = append(domains, domain)
+		lock.Unlock()
+		return &http.Client{}
+	}
+
+	newTask := func(t *testing.T, destinationPath string, urlPath string) *Task {
+		ur, err := url.Parse(fmt.Sprintf("%s%s", server.URL, urlPath))
+		assert.Nil(t, err)
+
+		return &Task{
+			DestinationPath: destinationPath,
+			PkgURL:          *ur,
+			PkgURLSignature: "bogus",
+		}
+	}
+
+	waitFor := func(t *testing.T, task *Task) {
+		select {
+		case <-task.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for Task %v", task.DestinationPath)
+		}
+	}
+
+	suite.Run("Pool rejects malformed Tasks and Cancelations", func(t *testing.T) {
+		pool, err := NewPool(tmpDir, producer)
+		assert.Nil(t, err)
+
+		assert.NotNil(t, pool.EnqueueFetch(&Task{}))
+		assert.NotNil(t, pool.CancelFetch(&Cancelation{}))
+	})
+
+	suite.Run("QueueProcessor records a Try per attempt and gives up after MaxTries", func(t *testing.T) {
+		pool, err := NewPool(tmpDir, producer)
+		assert.Nil(t, err)
+		pool.FetchOptions = &fetch.Options{RetryPolicy: &fetch.RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+
+		processor, err := NewQueueProcessor(pool, 2)
+		assert.Nil(t, err)
+		processor.Start()
+		defer processor.Stop()
+
+		task := newTask(t, "missing", "/missing.json")
+		started := time.Now()
+		assert.Nil(t, pool.EnqueueFetch(task))
+		assert.NotNil(t, pool.EnqueueFetch(task))
+		waitFor(t, task)
+
+		// tries are spaced by the retry policy's backoff, 100ms then 200ms
+		assert.True(t, time.Since(started) >= 300*time.Millisecond, time.Since(started))
+		assert.EqualValues(t, defaultMaxTries, len(task.TryHistory))
+		for _, try := range task.TryHistory {
+			assert.False(t, try.FetchSuccess)
+			assert.NotNil(t, try.FetchErr)
+			assert.NotZero(t, try.FetchStartedAt)
+		}
+
+		ur, _ := url.Parse(server.URL)
+		lock.Lock()
+		assert.Contains(t, domains, ur.Host)
+		lock.Unlock()
+	})
+
+	suite.Run("QueueProcessor fetches a signed Pkg with the client made for its domain", func(t *testing.T) {
+		pkgServer, pkg, sig := serveSignedPkg(t, tmpDir)
+		defer pkgServer.Close()
+
+		transport := &countingTransport{}
+		var pkgDomains []string
+		pool, err := NewPool(path.Join(tmpDir, "fetched"), func(domain string) *http.Client {
+			lock.Lock()
+			pkgDomains = append(pkgDomains, domain)
+			lock.Unlock()
+			return &http.Client{Transport: transport}
+		})
+		assert.Nil(t, err)
+
+		processor, err := NewQueueProcessor(pool, 1)
+		assert.Nil(t, err)
+		processor.Start()
+		defer processor.Stop()
+
+		ur, err := url.Parse(fmt.Sprintf("%s/%s.json", pkgServer.URL, pkgID))
+		assert.Nil(t, err)
+		task := &Task{
+			DestinationPath: "signed",
+			PkgURL:          *ur,
+			PkgURLSignature: sig,
+			KeyFiles:        []string{path.Join(testMaterialDir, "keys", "public.pem")},
+		}
+		assert.Nil(t, pool.EnqueueFetch(task))
+		waitFor(t, task)
+
+		assert.EqualValues(t, 1, len(task.TryHistory))
+		assert.True(t, task.TryHistory[0].FetchSuccess)
+		assert.Nil(t, task.TryHistory[0].FetchErr)
+		assert.NotZero(t, task.TryHistory[0].FetchStartedAt)
+
+		assert.NotNil(t, task.Pkg)
+		assert.EqualValues(t, pkg.ID, task.Pkg.ID)
+		assert.EqualValues(t, len(pkg.Parts), len(task.Fetched))
+		for repotag, partPath := range task.Fetched {
+			info, err := os.Stat(partPath)
+			assert.Nil(t, err, repotag)
+			assert.EqualValues(t, pkg.Parts[filepath.Base(partPath)].Bytes, info.Size())
+		}
+
+		// the meta file and every part were requested with the domain's client
+		assert.True(t, transport.count() >= 1+len(pkg.Parts), transport.count())
+		ur, _ = url.Parse(pkgServer.URL)
+		lock.Lock()
+		assert.EqualValues(t, []string{ur.Host}, pkgDomains)
+		lock.Unlock()
+	})
+
+	suite.Run("QueueProcessor processes Tasks sent directly to the fetch buffer", func(t *testing.T) {
+		pool, err := NewPool(tmpDir, producer)
+		assert.Nil(t, err)
+		pool.MaxTries = 1
+
+		processor, err := NewQueueProcessor(pool, 1)
+		assert.Nil(t, err)
+		processor.Start()
+		defer processor.Stop()
+
+		task := newTask(t, "direct", "/missing.json")
+		pool.FetchBuffer <- nil
+		pool.FetchBuffer <- task
+		waitFor(t, task)
+
+		assert.EqualValues(t, 1, len(task.TryHistory))
+	})
+
+	suite.Run("QueueProcessor drops a Task canceled before it is fetched", func(t *testing.T) {
+		pool, err := NewPool(tmpDir, producer)
+		assert.Nil(t, err)
+		pool.MaxTries = 1
+
+		processor, err := NewQueueProcessor(pool, 1)
+		assert.Nil(t, err)
+		processor.Start()
+		defer processor.Stop()
+
+		// the only worker is kept busy so the canceled Task waits in the buffer
+		busy := newTask(t, "busy", "/stall.json")
+		assert.Nil(t, pool.EnqueueFetch(busy))
+		time.Sleep(100 * time.Millisecond)
+
+		lock.Lock()
+		before := requests
+		lock.Unlock()
+
+		task := newTask(t, "canceled", "/missing.json")
+		assert.Nil(t, pool.EnqueueFetch(task))
+		assert.Nil(t, pool.CancelFetch(&Cancelation{DestinationPath: "canceled", CanceledBy: "test"}))
+		time.Sleep(100 * time.Millisecond)
+
+		assert.Nil(t, pool.CancelFetch(&Cancelation{DestinationPath: "busy", CanceledBy: "test"}))
+		waitFor(t, busy)
+		waitFor(t, task)
+
+		assert.EqualValues(t, 0, len(task.TryHistory))
+		assert.NotZero(t, task.Cancelation.CanceledOn)
+		assert.EqualValues(t, "test", task.Cancelation.CanceledBy)
+
+		lock.Lock()
+		assert.EqualValues(t, before, requests)
+		lock.Unlock()
+	})
+
+	suite.Run("QueueProcessor discards cancelations matching no queued or in-flight Task", func(t *testing.T) {
+		pool, err := NewPool(tmpDir, producer)
+		assert.Nil(t, err)
+		pool.MaxTries = 1
+
+		processor, err := NewQueueProcessor(pool, 1)
+		assert.Nil(t, err)
+		processor.Start()
+		defer processor.Stop()
+
+		// a cancelation of a Task never enqueued and one of a Task finished
+		assert.Nil(t, pool.CancelFetch(&Cancelation{DestinationPath: "refetched", CanceledBy: "test"}))
+		first := newTask(t, "refetched", "/missing.json")
+		assert.Nil(t, pool.EnqueueFetch(first))
+		waitFor(t, first)
+		assert.Nil(t, pool.CancelFetch(&Cancelation{DestinationPath: "refetched", CanceledBy: "test"}))
+		time.Sleep(100 * time.Millisecond)
+
+		// neither drops a later Task fetching into the same path
+		second := newTask(t, "refetched", "/missing.json")
+		assert.Nil(t, pool.EnqueueFetch(second))
+		waitFor(t, second)
+
+		assert.EqualValues(t, 1, len(second.TryHistory))
+		assert.Zero(t, second.Cancelation.CanceledOn)
+	})
+
+	suite.Run("QueueProcessor aborts an in-flight fetch when its Task is canceled", func(t *testing.T) {
+		pool, err := NewPool(tmpDir, producer)
+		assert.Nil(t, err)
+
+		processor, err := NewQueueProcessor(pool, 1)
+		assert.Nil(t, err)
+		processor.Start()
+		defer processor.Stop()
+
+		task := newTask(t, "stalled", "/stall.json")
+		assert.Nil(t, pool.EnqueueFetch(task))
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Nil(t, pool.CancelFetch(&Cancelation{DestinationPath: "stalled", CanceledBy: "test"}))
+		waitFor(t, task)
+
+		assert.EqualValues(t, 1, len(task.TryHistory))
+		assert.False(t, task.TryHistory[0].FetchSuccess)
+		assert.NotZero(t, task.Cancelation.CanceledOn)
+	})
+}
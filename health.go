@@ -0,0 +1,265 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// healthSmoothing is the weight of the newest sample in a host's moving
+	// averages of latency and throughput
+	healthSmoothing = 0.3
+
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = 5 * time.Minute
+)
+
+// SourceHealth keeps statistics of the hosts parts are downloaded from and
+// uses them to order each part's sources by expected performance. A host
+// that fails BreakerThreshold times in a row is skipped for BreakerCooldown,
+// unless all of a part's sources are in that state. After the cooldown the
+// host is tried again; it's skipped again if that fails too. A single
+// SourceHealth may be shared by the options of many fetches so that they all
+// learn from each other. The zero value is ready to use, its circuit breaker
+// disabled; NewSourceHealth returns one with default breaker settings.
+type SourceHealth struct {
+	BreakerThreshold int           // consecutive failures that trip a host's circuit breaker; zero disables it
+	BreakerCooldown  time.Duration // how long a tripped host is skipped
+
+	lock  sync.Mutex
+	hosts map[string]*HostStats // made when first needed
+}
+
+// HostStats is a snapshot of the health of a source host
+type HostStats struct {
+	Host                string
+	Requests            int
+	Failures            int
+	ConsecutiveFailures int
+	Latency             time.Duration // moving average of the time to receive response headers
+	Throughput          float64       // moving average of download rate in bytes per second
+	LastFailure         time.Time
+	LastError           string
+	BrokenUntil         time.Time // the host is skipped until then if its circuit breaker tripped
+}
+
+// CircuitOpen reports if the host is being skipped at the given time
+func (s HostStats) CircuitOpen(now time.Time) bool {
+	return now.Before(s.BrokenUntil)
+}
+
+// NewSourceHealth returns a SourceHealth with default circuit breaker
+// settings which the caller may change before first use
+func NewSourceHealth() *SourceHealth {
+	return &SourceHealth{
+		BreakerThreshold: defaultBreakerThreshold,
+		BreakerCooldown:  defaultBreakerCooldown,
+	}
+}
+
+// Stats returns a snapshot of the statistics of every host seen so far,
+// keyed by host
+func (h *SourceHealth) Stats() map[string]HostStats {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	stats := make(map[string]HostStats, 0)
+	for host, s := range h.hosts {
+		stats[host] = *s
+	}
+	return stats
+}
+
+func (h *SourceHealth) host(host string) *HostStats {
+	if h.hosts == nil {
+		h.hosts = make(map[string]*HostStats)
+	}
+
+	s, exists := h.hosts[host]
+	if !exists {
+		s = &HostStats{Host: host}
+		h.hosts[host] = s
+	}
+	return s
+}
+
+// succeeded records a successful request to the host; a nil SourceHealth
+// records nothing
+func (h *SourceHealth) succeeded(host string, latency time.Duration, bytes int64, transfer time.Duration) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.host(host)
+	first := s.Requests == s.Failures
+	s.Requests++
+	s.ConsecutiveFailures = 0
+	s.BrokenUntil = time.Time{}
+
+	if first {
+		s.Latency = latency
+	} else {
+		s.Latency = time.Duration(healthSmoothing*float64(latency) + (1-healthSmoothing)*float64(s.Latency))
+	}
+
+	if bytes > 0 && transfer > 0 {
+		rate := float64(bytes) / transfer.Seconds()
+		if s.Throughput == 0 {
+			s.Throughput = rate
+		} else {
+			s.Throughput = healthSmoothing*rate + (1-healthSmoothing)*s.Throughput
+		}
+	}
+}
+
+// failed records a failed request to the host, tripping its circuit breaker
+// if it has failed too often in a row
+func (h *SourceHealth) failed(host string, err error) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.host(host)
+	s.Requests++
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastFailure = time.Now()
+	if err != nil {
+		s.LastError = Redact(err.Error())
+	}
+
+	if h.BreakerThreshold > 0 && s.ConsecutiveFailures >= h.BreakerThreshold {
+		s.BrokenUntil = s.LastFailure.Add(h.BreakerCooldown)
+		glog.Errorf("Source host %v failed %v times in a row, skipping it until %v. Last error: %v", host, s.ConsecutiveFailures, s.BrokenUntil, s.LastError)
+	}
+}
+
+// cost estimates the time to download the given number of bytes from the
+// host. Hosts not seen yet cost nothing so that they're tried; hosts that
+// have only ever failed cost the most.
+func (h *SourceHealth) cost(host string, bytes int64) float64 {
+	s, exists := h.hosts[host]
+	if !exists {
+		return 0
+	} else if s.Requests == s.Failures {
+		return math.MaxFloat64
+	}
+
+	cost := s.Latency.Seconds()
+	if s.Throughput > 0 {
+		cost += float64(bytes) / s.Throughput
+	}
+	return cost * float64(1+s.ConsecutiveFailures)
+}
+
+// order returns the given source URLs sorted by the expected cost of
+// downloading the given number of bytes from each, less those on hosts whose
+// circuit breaker is open. If every source is on such a host, all are
+// returned. A nil SourceHealth returns the URLs as given.
+func (h *SourceHealth) order(urls []string, bytes int64) []string {
+	if h == nil {
+		return urls
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	costs := make(map[string]float64, 0)
+	var healthy, broken []string
+	for _, pURL := range urls {
+		host := sourceHost(pURL)
+		costs[pURL] = h.cost(host, bytes)
+
+		if s, exists := h.hosts[host]; exists && s.CircuitOpen(now) {
+			broken = append(broken, pURL)
+		} else {
+			healthy = append(healthy, pURL)
+		}
+	}
+
+	ordered := healthy
+	if len(healthy) == 0 {
+		glog.Errorf("Circuit breakers of all sources %v are open, trying them anyway", redactURLs(urls))
+		ordered = broken
+	} else if len(broken) > 0 {
+		glog.V(3).Infof("Skipping sources with open circuit breakers: %v", redactURLs(broken))
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return costs[ordered[i]] < costs[ordered[j]]
+	})
+	return ordered
+}
+
+// sourceHost returns the host of the URL by which its health is tracked
+func sourceHost(pURL string) string {
+	parsed, err := url.Parse(pURL)
+	if err != nil {
+		return pURL
+	}
+	return parsed.Host
+}
+
+// hostFailure reports if a failed request reflects on the health of the host.
+// Authorization failures and rejected ranges are the client's problem.
+func hostFailure(failure *partFetchFailure) bool {
+	switch failure.HTTPStatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestedRangeNotSatisfiable:
+		return false
+	default:
+		return failure.Err != errRangesUnsupported
+	}
+}
+
+// sourceRequest measures a single request to a source for the statistics of
+// its host
+type sourceRequest struct {
+	health    *SourceHealth
+	host      string
+	sent      time.Time
+	responded time.Time
+	bytes     int64 // the bytes of content received
+}
+
+// request starts the measurement of a request to the given host
+func (h *SourceHealth) request(host string) *sourceRequest {
+	return &sourceRequest{health: h, host: host, sent: time.Now()}
+}
+
+// responded marks the receipt of response headers
+func (r *sourceRequest) response() {
+	r.responded = time.Now()
+}
+
+// done records the outcome of the request, if it was successful or failed
+// due to the host. Requests that were canceled or failed locally aren't
+// recorded.
+func (r *sourceRequest) done(ctx context.Context, ok bool, failure *partFetchFailure) {
+	if r.health == nil || ctx.Err() != nil {
+		return
+	}
+
+	if ok && !r.responded.IsZero() {
+		r.health.succeeded(r.host, r.responded.Sub(r.sent), r.bytes, time.Since(r.responded))
+	} else if failure != nil && hostFailure(failure) {
+		err := failure.Err
+		if err == nil {
+			err = fmt.Errorf("Unexpected HTTP status code: %v", failure.HTTPStatusCode)
+		}
+		r.health.failed(r.host, err)
+	}
+}
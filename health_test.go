@@ -0,0 +1,109 @@
+// +build unit
+
+package fetch
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_SourceHealth_Suite(suite *testing.T) {
+	fast := "http://fast.example.com/part.tgz"
+	slow := "http://slow.example.com:8080/part.tgz"
+	flaky := "https://flaky.example.com/part.tgz"
+	fresh := "http://fresh.example.com/part.tgz"
+
+	suite.Run("nil SourceHealth keeps the given order", func(t *testing.T) {
+		var health *SourceHealth
+		assert.EqualValues(t, []string{slow, fast}, health.order([]string{slow, fast}, 1024))
+	})
+
+	suite.Run("sources are ordered by expected cost", func(t *testing.T) {
+		health := NewSourceHealth()
+		health.succeeded("fast.example.com", 10*time.Millisecond, 1024*1024, time.Second)
+		health.succeeded("slow.example.com:8080", 200*time.Millisecond, 1024, time.Second)
+
+		// hosts not seen yet are tried first
+		assert.EqualValues(t, []string{fresh, fast, slow}, health.order([]string{slow, fast, fresh}, 1024*1024))
+
+		stats := health.Stats()
+		assert.EqualValues(t, 1, stats["fast.example.com"].Requests)
+		assert.EqualValues(t, 1024*1024, stats["fast.example.com"].Throughput)
+		assert.EqualValues(t, 200*time.Millisecond, stats["slow.example.com:8080"].Latency)
+	})
+
+	suite.Run("SourceHealth literals work without NewSourceHealth", func(t *testing.T) {
+		health := &SourceHealth{BreakerThreshold: 2, BreakerCooldown: time.Minute}
+		assert.Empty(t, health.Stats())
+		assert.EqualValues(t, []string{flaky, fast}, health.order([]string{flaky, fast}, 1024))
+
+		health.succeeded("fast.example.com", 10*time.Millisecond, 1024, time.Second)
+		health.failed("flaky.example.com", errors.New("connection reset"))
+		health.failed("flaky.example.com", errors.New("connection reset"))
+		assert.EqualValues(t, []string{fast}, health.order([]string{flaky, fast}, 1024))
+		assert.True(t, health.Stats()["flaky.example.com"].CircuitOpen(time.Now()))
+
+		// the zero value's breaker is disabled
+		var zero SourceHealth
+		for ix := 0; ix < 5; ix++ {
+			zero.failed("flaky.example.com", errors.New("connection reset"))
+		}
+		assert.EqualValues(t, []string{fast, flaky}, zero.order([]string{fast, flaky}, 1024))
+	})
+
+	suite.Run("consecutive failures trip the circuit breaker", func(t *testing.T) {
+		health := NewSourceHealth()
+		health.BreakerThreshold = 2
+		health.BreakerCooldown = time.Hour
+
+		health.succeeded("flaky.example.com", 10*time.Millisecond, 1024*1024, time.Second)
+		health.succeeded("slow.example.com:8080", 200*time.Millisecond, 1024, time.Second)
+
+		// a failure makes a host look slower, but not this much slower
+		health.failed("flaky.example.com", errors.New("connection reset"))
+		assert.EqualValues(t, []string{flaky, slow}, health.order([]string{slow, flaky}, 1024))
+
+		health.failed("flaky.example.com", errors.New("connection reset"))
+		assert.EqualValues(t, []string{slow}, health.order([]string{flaky, slow}, 1024))
+
+		stats := health.Stats()["flaky.example.com"]
+		assert.True(t, stats.CircuitOpen(time.Now()))
+		assert.False(t, stats.CircuitOpen(time.Now().Add(2*time.Hour)))
+		assert.EqualValues(t, 2, stats.ConsecutiveFailures)
+		assert.EqualValues(t, "connection reset", stats.LastError)
+
+		// with nothing else to try, open hosts are tried anyway
+		assert.EqualValues(t, []string{flaky}, health.order([]string{flaky}, 1024))
+
+		// a success closes the breaker
+		health.succeeded("flaky.example.com", 10*time.Millisecond, 1024*1024, time.Second)
+		assert.False(t, health.Stats()["flaky.example.com"].CircuitOpen(time.Now()))
+		assert.EqualValues(t, []string{flaky, slow}, health.order([]string{flaky, slow}, 1024))
+	})
+
+	suite.Run("only failures of the host are recorded", func(t *testing.T) {
+		health := NewSourceHealth()
+
+		request := health.request("fast.example.com")
+		request.done(context.Background(), false, &partFetchFailure{http.StatusForbidden, fast, nil})
+
+		request = health.request("fast.example.com")
+		request.response()
+		request.done(context.Background(), false, &partFetchFailure{http.StatusOK, fast, errRangesUnsupported})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		request = health.request("fast.example.com")
+		request.done(ctx, false, &partFetchFailure{0, fast, context.Canceled})
+		assert.Empty(t, health.Stats())
+
+		request = health.request("fast.example.com")
+		request.response()
+		request.done(context.Background(), false, &partFetchFailure{http.StatusBadGateway, fast, nil})
+		assert.EqualValues(t, 1, health.Stats()["fast.example.com"].Failures)
+	})
+}
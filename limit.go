@@ -0,0 +1,146 @@
+package fetch
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// minThrottledRead is the smallest read made through a BandwidthLimiter so
+// that very low limits don't degrade into byte-at-a-time reads
+const minThrottledRead = 512
+
+// BandwidthLimiter caps the rate at which part content is downloaded. A
+// single limiter may be shared by the options of many fetches, including
+// concurrent ones, to cap their combined rate. The zero value doesn't limit
+// the rate.
+type BandwidthLimiter struct {
+	bytesPerSecond int64 // zero means unlimited
+
+	lock sync.Mutex
+	// next is the time by which all bytes read so far are paid for
+	next time.Time
+}
+
+// NewBandwidthLimiter returns a limiter that admits the given number of bytes
+// per second in total to all of the downloads using it; a rate less than 1
+// means unlimited
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+
+	return &BandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+// BytesPerSecond returns the limiter's rate, zero if it's unlimited
+func (l *BandwidthLimiter) BytesPerSecond() int64 {
+	return l.bytesPerSecond
+}
+
+// readSize is the largest read that should be made at once, about a tenth of
+// a second's worth of content; zero means any size
+func (l *BandwidthLimiter) readSize() int {
+	if l.bytesPerSecond == 0 {
+		return 0
+	}
+
+	size := l.bytesPerSecond / 10
+	if size < minThrottledRead {
+		return minThrottledRead
+	}
+	return int(size)
+}
+
+// wait accounts for n bytes having been read and blocks until the rate
+// allows them. It returns false if the context was done first.
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) bool {
+	if l.bytesPerSecond == 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		// unused capacity isn't saved up
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	return sleep(ctx, delay)
+}
+
+// throttledReader is an io.Reader whose reads are paced by a BandwidthLimiter
+type throttledReader struct {
+	ctx     context.Context
+	limiter *BandwidthLimiter
+	reader  io.Reader
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	if size := r.limiter.readSize(); size > 0 && len(p) > size {
+		p = p[:size]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 && !r.limiter.wait(r.ctx, n) {
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
+
+// HostLimiter caps the number of concurrent part downloads from any one host.
+// Like a BandwidthLimiter, it may be shared by the options of many fetches.
+// The zero value doesn't limit connections.
+type HostLimiter struct {
+	maxPerHost int // zero means unlimited
+
+	lock  sync.Mutex
+	hosts map[string]chan struct{} // made when first needed
+}
+
+// NewHostLimiter returns a limiter that allows at most maxPerHost concurrent
+// part downloads from each host; a maximum less than 1 means unlimited
+func NewHostLimiter(maxPerHost int) *HostLimiter {
+	if maxPerHost < 0 {
+		maxPerHost = 0
+	}
+
+	return &HostLimiter{
+		maxPerHost: maxPerHost,
+	}
+}
+
+// acquire blocks until a connection to the given host is available, returning
+// a function to release it. It returns false if the context was done first.
+func (l *HostLimiter) acquire(ctx context.Context, host string) (func(), bool) {
+	if l.maxPerHost == 0 {
+		return func() {}, true
+	}
+
+	l.lock.Lock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]chan struct{})
+	}
+	slots, exists := l.hosts[host]
+	if !exists {
+		slots = make(chan struct{}, l.maxPerHost)
+		l.hosts[host] = slots
+	}
+	l.lock.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,102 @@
+// +build unit
+
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Limiters_Suite(suite *testing.T) {
+
+	suite.Run("BandwidthLimiter caps the combined rate of its readers", func(t *testing.T) {
+		limiter := NewBandwidthLimiter(20 * 1024)
+
+		var group sync.WaitGroup
+		started := time.Now()
+		for ix := 0; ix < 2; ix++ {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				n, err := io.Copy(ioutil.Discard, throttledReader{context.Background(), limiter, bytes.NewReader(make([]byte, 10*1024))})
+				assert.Nil(t, err)
+				assert.EqualValues(t, 10*1024, n)
+			}()
+		}
+		group.Wait()
+
+		// 20 KiB at 20 KiB/s, less the first read which is admitted at once
+		assert.True(t, time.Since(started) >= 800*time.Millisecond, "finished in %v", time.Since(started))
+	})
+
+	suite.Run("BandwidthLimiter waits are canceled with their context", func(t *testing.T) {
+		limiter := NewBandwidthLimiter(1024)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		started := time.Now()
+		_, err := io.Copy(ioutil.Discard, throttledReader{ctx, limiter, bytes.NewReader(make([]byte, 10*1024))})
+		assert.EqualValues(t, context.DeadlineExceeded, err)
+		assert.True(t, time.Since(started) < 2*time.Second)
+	})
+
+	suite.Run("BandwidthLimiter zero value and zero rate are unlimited", func(t *testing.T) {
+		for _, limiter := range []*BandwidthLimiter{&BandwidthLimiter{}, NewBandwidthLimiter(0)} {
+			started := time.Now()
+			n, err := io.Copy(ioutil.Discard, throttledReader{context.Background(), limiter, bytes.NewReader(make([]byte, 1024*1024))})
+			assert.Nil(t, err)
+			assert.EqualValues(t, 1024*1024, n)
+			assert.True(t, time.Since(started) < time.Second, "finished in %v", time.Since(started))
+			assert.Zero(t, limiter.BytesPerSecond())
+		}
+	})
+
+	suite.Run("HostLimiter bounds connections per host", func(t *testing.T) {
+		limiter := NewHostLimiter(1)
+
+		release, ok := limiter.acquire(context.Background(), "a.example.com")
+		assert.True(t, ok)
+
+		// other hosts are unaffected
+		releaseB, ok := limiter.acquire(context.Background(), "b.example.com")
+		assert.True(t, ok)
+		releaseB()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, ok = limiter.acquire(ctx, "a.example.com")
+		assert.False(t, ok)
+
+		release()
+		release, ok = limiter.acquire(context.Background(), "a.example.com")
+		assert.True(t, ok)
+		release()
+	})
+
+	suite.Run("HostLimiter zero value and zero maximum are unlimited", func(t *testing.T) {
+		for _, limiter := range []*HostLimiter{&HostLimiter{}, NewHostLimiter(0)} {
+			var releases []func()
+			for ix := 0; ix < 10; ix++ {
+				release, ok := limiter.acquire(context.Background(), "a.example.com")
+				assert.True(t, ok)
+				releases = append(releases, release)
+			}
+			for _, release := range releases {
+				release()
+			}
+		}
+	})
+
+	suite.Run("HostLimiter zero value with a maximum set makes its hosts lazily", func(t *testing.T) {
+		limiter := &HostLimiter{maxPerHost: 1}
+		release, ok := limiter.acquire(context.Background(), "a.example.com")
+		assert.True(t, ok)
+		release()
+	})
+}
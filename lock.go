@@ -0,0 +1,107 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+const (
+	lockSuffix = ".lock"
+
+	// lockPollInterval is the delay between attempts to take a held lock
+	lockPollInterval = 100 * time.Millisecond
+
+	// defaultLockTimeout bounds the wait for another fetch's lock; it's long
+	// because the holder may be downloading a large part
+	defaultLockTimeout = 30 * time.Minute
+)
+
+// errLockHeld is returned by tryLock if the lock is held elsewhere
+var errLockHeld = errors.New("Lock is held by another fetch")
+
+// fileLock is an advisory lock on a file, coordinating fetches into the same
+// destination directory across goroutines and processes. Lock files are never
+// removed: doing so would let two fetches hold locks on different files of
+// the same name.
+type fileLock struct {
+	file *os.File
+}
+
+// lockPath returns the path of the lock file of the named Pkg or part in dir
+func lockPath(dir string, name string) string {
+	return path.Join(dir, "."+name+lockSuffix)
+}
+
+// acquireLock takes the lock at the given path, shared or exclusive, waiting
+// at most timeout for it. A fetcherrors.PkgLockTimeoutError is returned if
+// the wait times out; the context's error if it's done first.
+func acquireLock(ctx context.Context, lockPath string, exclusive bool, timeout time.Duration) (*fileLock, error) {
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	deadline := time.Now().Add(timeout)
+	for waiting := false; ; waiting = true {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			if waiting {
+				glog.V(3).Infof("Acquired lock %v", lockPath)
+			}
+			return &fileLock{file}, nil
+		} else if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("Unable to lock %v. Error: %v", lockPath, err)
+		}
+
+		if !time.Now().Before(deadline) {
+			file.Close()
+			if timeout <= 0 {
+				return nil, errLockHeld
+			}
+			return nil, fetcherrors.PkgLockTimeoutError{fmt.Sprintf("Timed out after %v waiting for lock %v held by another fetch", timeout, lockPath), errLockHeld}
+		}
+
+		if !waiting {
+			glog.V(3).Infof("Lock %v is held by another fetch, waiting up to %v for it", lockPath, timeout)
+		}
+
+		if !sleep(ctx, lockPollInterval) {
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryLock takes the lock at the given path only if it's free; errLockHeld is
+// returned if it isn't
+func tryLock(lockPath string, exclusive bool) (*fileLock, error) {
+	return acquireLock(context.Background(), lockPath, exclusive, 0)
+}
+
+// release gives up the lock
+func (l *fileLock) release() {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		glog.Errorf("Unable to unlock %v. Error: %v", l.file.Name(), err)
+	}
+	l.file.Close()
+}
+
+func (o *Options) lockTimeout() time.Duration {
+	if o.LockTimeout > 0 {
+		return o.LockTimeout
+	}
+	return defaultLockTimeout
+}
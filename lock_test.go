@@ -0,0 +1,70 @@
+// +build unit
+
+package fetch
+
+import (
+	"context"
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_FileLock_Suite(suite *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-lock-")
+	assert.Nil(suite, err)
+	defer os.RemoveAll(tmpDir)
+
+	suite.Run("exclusive locks exclude all others", func(t *testing.T) {
+		lp := lockPath(tmpDir, "exclusive")
+		assert.EqualValues(t, path.Join(tmpDir, ".exclusive.lock"), lp)
+
+		lock, err := acquireLock(context.Background(), lp, true, time.Second)
+		assert.Nil(t, err)
+
+		_, err = tryLock(lp, true)
+		assert.EqualValues(t, errLockHeld, err)
+		_, err = tryLock(lp, false)
+		assert.EqualValues(t, errLockHeld, err)
+
+		_, err = acquireLock(context.Background(), lp, false, 200*time.Millisecond)
+		_, ok := err.(fetcherrors.PkgLockTimeoutError)
+		assert.True(t, ok)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err = acquireLock(ctx, lp, true, time.Minute)
+		assert.EqualValues(t, context.DeadlineExceeded, err)
+
+		// a waiter gets the lock once it's released
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			lock.release()
+		}()
+		waiter, err := acquireLock(context.Background(), lp, true, time.Minute)
+		assert.Nil(t, err)
+		waiter.release()
+	})
+
+	suite.Run("shared locks exclude only exclusive ones", func(t *testing.T) {
+		lp := lockPath(tmpDir, "shared")
+
+		first, err := tryLock(lp, false)
+		assert.Nil(t, err)
+		second, err := tryLock(lp, false)
+		assert.Nil(t, err)
+
+		_, err = tryLock(lp, true)
+		assert.EqualValues(t, errLockHeld, err)
+
+		first.release()
+		second.release()
+
+		lock, err := tryLock(lp, true)
+		assert.Nil(t, err)
+		lock.release()
+	})
+}
@@ -0,0 +1,228 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// manifestSuffix is appended to a Pkg's ID to name its manifest file in the
+	// destination directory, alongside the Pkg meta file
+	manifestSuffix = ".fetch"
+)
+
+// FetchManifest records the outcome of a successful Pkg fetch. It is written
+// to <pkgID>.fetch in the destination directory and lets subsequent fetches
+// of the same Pkg skip the network.
+type FetchManifest struct {
+	PkgID     string                  `json:"pkg_id"`
+	PkgURL    string                  `json:"pkg_url"` // with credentials scrubbed; see Redact
+	FetchedAt time.Time               `json:"fetched_at"`
+	Parts     map[string]ManifestPart `json:"parts"` // keyed by docker image repotag
+}
+
+// ManifestPart records a fetched part in a FetchManifest
+type ManifestPart struct {
+	PartID     string    `json:"part_id"`
+	Path       string    `json:"path"` // absolute path of the part; empty if its fetch was skipped
+	Bytes      int64     `json:"bytes"`
+	Sha256sum  string    `json:"sha256sum"`
+	Skipped    bool      `json:"skipped"`
+	VerifiedAt time.Time `json:"verified_at"`
+	VerifiedBy []string  `json:"verified_by"` // the key files that verified the part's signatures
+}
+
+func manifestPath(destinationDir string, pkgID string) string {
+	return path.Join(destinationDir, pkgID+manifestSuffix)
+}
+
+// ReadFetchManifest reads the manifest of the Pkg with the given ID from the
+// given destination directory. Note that the manifest is not verified; it is
+// only as trustworthy as the destination directory.
+func ReadFetchManifest(destinationDir string, pkgID string) (*FetchManifest, error) {
+	raw, err := ioutil.ReadFile(manifestPath(destinationDir, pkgID))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest FetchManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// writeFetchManifest atomically writes the manifest to the destination
+// directory
+func writeFetchManifest(destinationDir string, manifest *FetchManifest) error {
+	serial, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(manifestPath(destinationDir, manifest.PkgID), serial)
+}
+
+// pkgIDFromURL guesses the ID of a Pkg from its URL; by convention a Pkg meta
+// file is named <pkgID>.json
+func pkgIDFromURL(pkgURL string) string {
+	return strings.TrimSuffix(path.Base(strings.SplitN(strings.SplitN(pkgURL, "?", 2)[0], "#", 2)[0]), ".json")
+}
+
+// pkgIDsByURL returns the IDs of the Pkgs in destinationDir whose files with
+// the given suffix record that they were fetched from the given URL, read
+// from each file by recordedURL. The Pkg named after the URL by convention
+// comes first and is returned if its file exists, whatever URL it records.
+// URLs are compared redacted so that those of pre-signed links match across
+// rotating signatures; what's found is only a candidate until its meta file
+// is verified.
+func pkgIDsByURL(destinationDir string, pkgURL string, suffix string, recordedURL func(raw []byte) (string, error)) []string {
+	var ids []string
+
+	conventional := pkgIDFromURL(pkgURL)
+	if checkPkgID(conventional) == nil {
+		if _, err := os.Stat(path.Join(destinationDir, conventional+suffix)); err == nil {
+			ids = append(ids, conventional)
+		}
+	}
+
+	matches, err := filepath.Glob(path.Join(destinationDir, "*"+suffix))
+	if err != nil {
+		return ids
+	}
+
+	redacted := Redact(pkgURL)
+	for _, match := range matches {
+		id := strings.TrimSuffix(path.Base(match), suffix)
+		if id == conventional || checkPkgID(id) != nil {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		if recorded, err := recordedURL(raw); err == nil && Redact(recorded) == redacted {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// manifestURL returns the URL of the Pkg a manifest records
+func manifestURL(raw []byte) (string, error) {
+	var manifest FetchManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return "", err
+	}
+	return manifest.PkgURL, nil
+}
+
+// fetchFromManifest attempts to satisfy a fetch from a manifest and Pkg meta
+// file written by a previous fetch into destinationDir. Manifests are found
+// by the URL they record as well as by the Pkg ID the URL is named after, so
+// a Pkg published as, say, latest.json is found too. The local meta file
+// must be verified by the given signature, ensuring it's the Pkg that was
+// requested, and every part recorded in the manifest must still be on disk
+// with the expected size. If the options' VerifyManifestHashes is set, each
+// part's content is hashed again too. Like a fetch, the check holds the Pkg's lock shared so
+// that the Pkg isn't removed from under it. An error satisfying
+// os.IsNotExist is returned if there's no manifest to try.
+func fetchFromManifest(ctx context.Context, pkgURL string, pkgURLSignature string, destinationDir string, keyFiles []string, options *Options) (*horizonpkg.Pkg, *FetchManifest, error) {
+	candidates := pkgIDsByURL(destinationDir, pkgURL, manifestSuffix, manifestURL)
+	if len(candidates) == 0 {
+		return nil, nil, os.ErrNotExist
+	}
+
+	var err error
+	for _, pkgID := range candidates {
+		var pkg *horizonpkg.Pkg
+		var manifest *FetchManifest
+		if pkg, manifest, err = fetchFromPkgManifest(ctx, pkgID, pkgURLSignature, destinationDir, keyFiles, options); err == nil {
+			return pkg, manifest, nil
+		} else if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		glog.V(5).Infof("Manifest of Pkg %v unusable for fetch of %v. Reason: %v", pkgID, Redact(pkgURL), redactError(err))
+	}
+
+	return nil, nil, err
+}
+
+// fetchFromPkgManifest attempts to satisfy a fetch from the manifest of the
+// Pkg with the given ID; see fetchFromManifest
+func fetchFromPkgManifest(ctx context.Context, pkgID string, pkgURLSignature string, destinationDir string, keyFiles []string, options *Options) (*horizonpkg.Pkg, *FetchManifest, error) {
+	pkgLock, err := acquireLock(ctx, lockPath(destinationDir, pkgID), false, options.lockTimeout())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pkgLock.release()
+
+	manifest, err := ReadFetchManifest(destinationDir, pkgID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawMeta, err := ioutil.ReadFile(path.Join(destinationDir, fmt.Sprintf("%v.json", pkgID)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkg, err := verifyPkgMeta(rawMeta, pkgURLSignature, keyFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pkg.ID != pkgID || manifest.PkgID != pkgID {
+		return nil, nil, fmt.Errorf("Pkg ID mismatch between manifest file (%v), meta file (%v) and manifest (%v)", pkgID, pkg.ID, manifest.PkgID)
+	}
+
+	partsMap, err := precheckPkgParts(pkg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(partsMap) != len(manifest.Parts) {
+		return nil, nil, fmt.Errorf("Manifest records %v parts, Pkg has %v", len(manifest.Parts), len(partsMap))
+	}
+
+	for repotag, part := range partsMap {
+		record, exists := manifest.Parts[repotag]
+		if !exists || record.Skipped || record.PartID != part.ID || record.Sha256sum != part.Sha256sum || record.Bytes != part.Bytes {
+			return nil, nil, fmt.Errorf("Manifest record of part %v doesn't match Pkg", repotag)
+		}
+
+		info, err := os.Stat(record.Path)
+		if err != nil {
+			return nil, nil, err
+		} else if info.Size() != part.Bytes {
+			return nil, nil, fmt.Errorf("Part %v on disk is %v bytes, expected %v", record.Path, info.Size(), part.Bytes)
+		}
+
+		if options.VerifyManifestHashes {
+			digest, err := hashFile(ctx, record.Path)
+			if err != nil {
+				return nil, nil, err
+			} else if fmt.Sprintf("%x", digest) != part.Sha256sum {
+				return nil, nil, fmt.Errorf("Part %v on disk doesn't match its expected hash", record.Path)
+			}
+		}
+	}
+
+	glog.V(3).Infof("Pkg %v satisfied by manifest written %v", pkgID, manifest.FetchedAt)
+	if err := touchPkg(destinationDir, pkgID); err != nil {
+		glog.Errorf("Unable to record use of Pkg %v. Error: %v", pkgID, err)
+	}
+	return pkg, manifest, nil
+}
@@ -0,0 +1,103 @@
+package fetch
+
+import (
+	"time"
+)
+
+// Options tunes the behavior of a Pkg fetch. A nil *Options is equivalent to
+// the zero value, which selects a default for every setting.
+type Options struct {
+	// RetryPolicy governs retries of failed part downloads; if nil,
+	// DefaultRetryPolicy() is used
+	RetryPolicy *RetryPolicy
+
+	// TrustPolicy governs verification of part signatures; if nil,
+	// DefaultTrustPolicy() is used
+	TrustPolicy *TrustPolicy
+
+	// VerifyManifestHashes makes a fetch satisfied by the manifest of a
+	// previous fetch hash every part on disk again rather than trusting its
+	// size
+	VerifyManifestHashes bool
+
+	// OnAttempt, if set, is called with a record of every attempt to download
+	// a part from one of its sources. It's called concurrently from the
+	// goroutines fetching parts.
+	OnAttempt func(attempt FetchAttempt)
+
+	// Progress, if set, receives events as each part is fetched and verified
+	Progress ProgressObserver
+
+	// MaxConcurrentParts bounds the number of parts of a Pkg downloaded at
+	// once; if zero, all of them are
+	MaxConcurrentParts int
+
+	// Bandwidth, if set, caps the combined rate of every part download using
+	// it. Share one limiter among the options of several fetches to cap them
+	// all together.
+	Bandwidth *BandwidthLimiter
+
+	// HostConnections, if set, bounds the number of part downloads from each
+	// host at once. Like Bandwidth, it may be shared among fetches.
+	HostConnections *HostLimiter
+
+	// ChunkPolicy, if set, has large parts downloaded in byte ranges from
+	// several of their sources at once; DefaultChunkPolicy() is a reasonable
+	// choice. If nil, each part is downloaded in a single stream.
+	ChunkPolicy *ChunkPolicy
+
+	// SourceHealth, if set, orders each part's sources by the past
+	// performance of their hosts and skips hosts that keep failing. Like
+	// Bandwidth, it may be shared among fetches.
+	SourceHealth *SourceHealth
+
+	// PartCache, if set, is consulted for each part before it's downloaded
+	// and receives every part verified. Sharing one cache among the fetches
+	// of several Pkgs means a part common to them is downloaded once.
+	PartCache *PartCache
+
+	// DiskSpaceReserve is the number of bytes that must remain free on the
+	// destination file system after the parts still to be downloaded are;
+	// a fetch that would leave less fails before downloading anything
+	DiskSpaceReserve int64
+
+	// SkipDiskSpaceCheck disables the check of free space on the destination
+	// file system before parts are downloaded
+	SkipDiskSpaceCheck bool
+
+	// LockTimeout bounds the wait for another fetch, possibly in another
+	// process, to finish with a part of the same Pkg; if zero, 30 minutes
+	LockTimeout time.Duration
+
+	// Authenticators authenticate requests of the URLs starting with their
+	// keys, the authenticator with the longest matching prefix winning. They
+	// take precedence over the Basic auth credentials given to a fetch for
+	// the same prefix.
+	Authenticators map[string]Authenticator
+}
+
+// withDefaults returns a copy of the given options with defaults filled in;
+// it's safe to call with nil
+func (o *Options) withDefaults() *Options {
+	var options Options
+	if o != nil {
+		options = *o
+	}
+
+	if options.RetryPolicy == nil {
+		options.RetryPolicy = DefaultRetryPolicy()
+	}
+
+	if options.TrustPolicy == nil {
+		options.TrustPolicy = DefaultTrustPolicy()
+	}
+
+	return &options
+}
+
+// recordAttempt hands the attempt to the configured observer, if any
+func (o *Options) recordAttempt(attempt FetchAttempt) {
+	if o.OnAttempt != nil {
+		o.OnAttempt(attempt)
+	}
+}
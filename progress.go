@@ -0,0 +1,198 @@
+package fetch
+
+import (
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"io"
+	"sync"
+)
+
+// PartEventType is a faux-enum identifying the kind of a ProgressEvent
+type PartEventType string
+
+const (
+	// PartStarted indicates that fetching of a part has begun
+	PartStarted PartEventType = "STARTED"
+
+	// PartDownloading reports bytes of a part written to disk so far
+	PartDownloading PartEventType = "DOWNLOADING"
+
+	// PartSourceSwitched indicates that a part is being fetched from another
+	// of its sources after the previous one failed
+	PartSourceSwitched PartEventType = "SOURCE_SWITCHED"
+
+	// PartVerifying indicates that a part's content is being verified
+	PartVerifying PartEventType = "VERIFYING"
+
+	// PartVerified indicates that a part was fetched and verified
+	PartVerified PartEventType = "VERIFIED"
+
+	// PartSkipped indicates that a part's fetch was skipped at the request of
+	// the caller's skip part function
+	PartSkipped PartEventType = "SKIPPED"
+
+	// PartFailed indicates that fetching or verifying a part failed; the
+	// event's Err describes why
+	PartFailed PartEventType = "FAILED"
+)
+
+// PkgProgress aggregates the progress of all parts of a Pkg
+type PkgProgress struct {
+	PkgID         string
+	Bytes         int64 // bytes of all parts on disk so far; skipped parts count as complete
+	TotalBytes    int64
+	PartsComplete int // verified or skipped parts
+	PartsFailed   int
+	PartsTotal    int
+}
+
+// Percent returns the fraction of the Pkg's bytes on disk as a percentage
+func (p PkgProgress) Percent() float64 {
+	if p.TotalBytes == 0 {
+		return 100
+	}
+	return float64(p.Bytes) * 100 / float64(p.TotalBytes)
+}
+
+// ProgressEvent describes a change in the state of a part's fetch along with
+// the aggregate progress of the whole Pkg.
+type ProgressEvent struct {
+	Type      PartEventType
+	PartID    string
+	Repotag   string
+	URL       string // the source in use, if one is
+	PartBytes int64  // bytes of the part on disk so far
+	PartTotal int64
+	Err       error // set for PartFailed events, with credentials redacted
+	Pkg       PkgProgress
+}
+
+// ProgressObserver receives progress events during a Pkg fetch. Calls to an
+// observer are serialized, but they are made from the goroutines fetching
+// parts so an observer should return quickly.
+type ProgressObserver func(event ProgressEvent)
+
+// progressTracker keeps the aggregate state of a Pkg fetch and reports every
+// change to the configured observer
+type progressTracker struct {
+	observer  ProgressObserver
+	lock      *sync.Mutex
+	pkg       PkgProgress
+	partBytes map[string]int64
+}
+
+func newProgressTracker(observer ProgressObserver, pkgID string, partsMap map[string]horizonpkg.DockerImagePart) *progressTracker {
+	tracker := &progressTracker{
+		observer:  observer,
+		lock:      &sync.Mutex{},
+		pkg:       PkgProgress{PkgID: pkgID, PartsTotal: len(partsMap)},
+		partBytes: make(map[string]int64),
+	}
+
+	for _, part := range partsMap {
+		tracker.pkg.TotalBytes += part.Bytes
+	}
+
+	return tracker
+}
+
+// part returns a handle for reporting progress on a single part
+func (t *progressTracker) part(repotag string, part horizonpkg.DockerImagePart) *partProgress {
+	return &partProgress{
+		tracker: t,
+		partID:  part.ID,
+		repotag: repotag,
+		total:   part.Bytes,
+	}
+}
+
+func (t *progressTracker) report(p *partProgress, eventType PartEventType, url string, bytes int64, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.pkg.Bytes += bytes - t.partBytes[p.partID]
+	t.partBytes[p.partID] = bytes
+
+	switch eventType {
+	case PartVerified, PartSkipped:
+		t.pkg.PartsComplete++
+	case PartFailed:
+		t.pkg.PartsFailed++
+	}
+
+	if t.observer == nil {
+		return
+	}
+
+	t.observer(ProgressEvent{
+		Type:      eventType,
+		PartID:    p.partID,
+		Repotag:   p.repotag,
+		URL:       url,
+		PartBytes: bytes,
+		PartTotal: p.total,
+		Err:       err,
+		Pkg:       t.pkg,
+	})
+}
+
+// partProgress reports the progress of a single part's fetch. Download
+// progress is reported no more often than every percent of the part's bytes.
+type partProgress struct {
+	tracker  *progressTracker
+	partID   string
+	repotag  string
+	total    int64
+	url      string
+	bytes    int64
+	reported int64
+}
+
+func (p *partProgress) started() {
+	p.tracker.report(p, PartStarted, "", p.bytes, nil)
+}
+
+func (p *partProgress) source(url string) {
+	if p.url != "" && p.url != url {
+		p.tracker.report(p, PartSourceSwitched, url, p.bytes, nil)
+	}
+	p.url = url
+}
+
+func (p *partProgress) downloaded(bytes int64) {
+	p.bytes = bytes
+	if bytes == p.total || bytes < p.reported || bytes-p.reported >= p.total/100 {
+		p.reported = bytes
+		p.tracker.report(p, PartDownloading, p.url, bytes, nil)
+	}
+}
+
+func (p *partProgress) verifying() {
+	p.tracker.report(p, PartVerifying, p.url, p.bytes, nil)
+}
+
+func (p *partProgress) verified() {
+	p.tracker.report(p, PartVerified, p.url, p.total, nil)
+}
+
+func (p *partProgress) skipped() {
+	p.tracker.report(p, PartSkipped, "", p.total, nil)
+}
+
+func (p *partProgress) failed(err error) {
+	p.tracker.report(p, PartFailed, p.url, p.bytes, err)
+}
+
+// progressWriter reports the bytes written through it as download progress;
+// offset is the number of bytes of the part already on disk
+type progressWriter struct {
+	writer   io.Writer
+	progress *partProgress
+	offset   int64
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.offset += int64(n)
+	w.progress.downloaded(w.offset)
+	return n, err
+}
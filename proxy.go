@@ -0,0 +1,155 @@
+package fetch
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxySettings configures the proxy through which a ClientBuilder's clients
+// reach sources, regardless of the process's HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables
+type ProxySettings struct {
+	// URL is that of the proxy, with a scheme of "http", "https" or
+	// "socks5" and optionally credentials. If empty, no proxy is used.
+	URL string
+
+	// Username and Password, if set, authenticate with the proxy in place of
+	// any credentials in its URL
+	Username string
+	Password string
+
+	// NoProxy lists the hosts reached directly rather than through the
+	// proxy, in the style of NO_PROXY: "*" for all hosts, an IP address, a
+	// CIDR block, or a domain name matching itself and its subdomains or,
+	// with a leading ".", only its subdomains. Each may be followed by a port
+	// to bypass the proxy only for that port. Loopback addresses aren't
+	// bypassed unless listed.
+	NoProxy []string
+}
+
+// proxyBypass is a NoProxy entry
+type proxyBypass struct {
+	all     bool
+	network *net.IPNet
+	ip      net.IP
+	domain  string
+	// subdomains only
+	subdomains bool
+	port       string
+}
+
+func parseProxyBypass(entry string) (*proxyBypass, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return nil, fmt.Errorf("Empty NoProxy entry")
+	} else if entry == "*" {
+		return &proxyBypass{all: true}, nil
+	}
+
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		return &proxyBypass{network: network}, nil
+	}
+
+	host, port := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		host, port = h, p
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &proxyBypass{ip: ip, port: port}, nil
+	}
+
+	bypass := &proxyBypass{port: port}
+	if strings.HasPrefix(host, ".") {
+		bypass.subdomains = true
+		host = strings.TrimPrefix(host, ".")
+	}
+	if host == "" {
+		return nil, fmt.Errorf("Invalid NoProxy entry %v", entry)
+	}
+	bypass.domain = host
+	return bypass, nil
+}
+
+// matches reports if the URL's host and port, the latter defaulted per the
+// URL's scheme, are bypassed
+func (b *proxyBypass) matches(host string, port string) bool {
+	if b.all {
+		return true
+	}
+
+	if b.port != "" && b.port != port {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case b.network != nil:
+		return ip != nil && b.network.Contains(ip)
+	case b.ip != nil:
+		return ip != nil && b.ip.Equal(ip)
+	case b.subdomains:
+		return strings.HasSuffix(host, "."+b.domain)
+	default:
+		return host == b.domain || strings.HasSuffix(host, "."+b.domain)
+	}
+}
+
+// proxyFunc returns a function for http.Transport.Proxy applying the
+// settings
+func (s *ProxySettings) proxyFunc() (func(req *http.Request) (*url.URL, error), error) {
+	if s.URL == "" {
+		return func(req *http.Request) (*url.URL, error) {
+			return nil, nil
+		}, nil
+	}
+
+	proxyURL, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL. Error: %v", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %v", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("Proxy URL has no host")
+	}
+
+	if s.Username != "" || s.Password != "" {
+		proxyURL.User = url.UserPassword(s.Username, s.Password)
+	}
+
+	var bypasses []*proxyBypass
+	for _, entry := range s.NoProxy {
+		bypass, err := parseProxyBypass(entry)
+		if err != nil {
+			return nil, err
+		}
+		bypasses = append(bypasses, bypass)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		port := req.URL.Port()
+		if port == "" {
+			if req.URL.Scheme == "https" {
+				port = "443"
+			} else {
+				port = "80"
+			}
+		}
+
+		for _, bypass := range bypasses {
+			if bypass.matches(host, port) {
+				return nil, nil
+			}
+		}
+		return proxyURL, nil
+	}, nil
+}
@@ -0,0 +1,186 @@
+package fetch
+
+import (
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redactedValue replaces credentials scrubbed from log lines and errors
+const redactedValue = "REDACTED"
+
+// redaction holds the names of the query parameters whose values are
+// scrubbed from URLs, lower cased
+var redaction = struct {
+	lock   sync.RWMutex
+	params map[string]bool
+}{
+	params: map[string]bool{
+		"access_token":         true,
+		"api_key":              true,
+		"apikey":               true,
+		"password":             true,
+		"secret":               true,
+		"sig":                  true,
+		"signature":            true,
+		"token":                true,
+		"x-amz-credential":     true,
+		"x-amz-security-token": true,
+		"x-amz-signature":      true,
+		"x-goog-credential":    true,
+		"x-goog-signature":     true,
+	},
+}
+
+// RedactQueryParameters adds to the names of the query parameters, like those
+// of pre-signed object storage links, whose values are scrubbed from every log
+// line and error the library produces. Names are matched case-insensitively;
+// common signature and token parameters are scrubbed without being added.
+func RedactQueryParameters(names ...string) {
+	redaction.lock.Lock()
+	defer redaction.lock.Unlock()
+
+	for _, name := range names {
+		redaction.params[strings.ToLower(name)] = true
+	}
+}
+
+func redactedParam(name string) bool {
+	redaction.lock.RLock()
+	defer redaction.lock.RUnlock()
+
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+	return redaction.params[strings.ToLower(name)]
+}
+
+var (
+	// URLs embedded in text, up to whitespace, quotes or brackets
+	urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>\[\]]+`)
+
+	// the password of a URL's userinfo, for URLs that don't parse
+	userinfoPasswordPattern = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*://[^/?#@:]*):[^/?#@]*@`)
+
+	// credentials following an authentication scheme
+	schemeCredentialsPattern = regexp.MustCompile(`(?i)\b(basic|bearer)(\s+)[a-zA-Z0-9\-._~+/]+=*`)
+
+	// the value of an Authorization header, as written or formatted in a
+	// map, with or without a scheme
+	authorizationPattern = regexp.MustCompile(`(?i)\b((?:proxy-)?authorization["']?\s*[:=]\s*\[?["']?)(?:([a-zA-Z][a-zA-Z0-9-]*)\s+)?([^\s"'\],]+)`)
+)
+
+// redactURLText scrubs the password and the values of redacted query
+// parameters from the URL; only the password is scrubbed from text that
+// doesn't parse as a URL, like a malformed one echoed by url.Parse
+func redactURLText(text string) string {
+	parsed, err := url.Parse(text)
+	if err != nil {
+		return userinfoPasswordPattern.ReplaceAllString(text, "${1}:"+redactedValue+"@")
+	}
+
+	changed := false
+
+	if parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), redactedValue)
+			changed = true
+		}
+	}
+
+	if parsed.RawQuery != "" {
+		params := strings.Split(parsed.RawQuery, "&")
+		for ix, param := range params {
+			name := strings.SplitN(param, "=", 2)[0]
+			if redactedParam(name) {
+				params[ix] = name + "=" + redactedValue
+				changed = true
+			}
+		}
+		parsed.RawQuery = strings.Join(params, "&")
+	}
+
+	if !changed {
+		return text
+	}
+	return parsed.String()
+}
+
+// Redact scrubs credentials from the given text: passwords in URLs, values
+// of redacted query parameters (see RedactQueryParameters) and Basic auth
+// credentials, bearer tokens and other Authorization header values.
+// Everything the library logs and the errors it returns are redacted this
+// way; it's exported for callers logging content of their own, like the
+// URLs in a FetchResult.
+func Redact(text string) string {
+	text = urlPattern.ReplaceAllStringFunc(text, redactURLText)
+	text = schemeCredentialsPattern.ReplaceAllString(text, "${1}${2}"+redactedValue)
+	text = authorizationPattern.ReplaceAllStringFunc(text, func(match string) string {
+		groups := authorizationPattern.FindStringSubmatch(match)
+		if groups[3] == redactedValue {
+			return match
+		} else if groups[2] != "" {
+			return groups[1] + groups[2] + " " + redactedValue
+		}
+		return groups[1] + redactedValue
+	})
+	return text
+}
+
+// redactURLs returns the given URLs redacted for logging
+func redactURLs(urls []string) []string {
+	redacted := make([]string, 0, len(urls))
+	for _, pURL := range urls {
+		redacted = append(redacted, Redact(pURL))
+	}
+	return redacted
+}
+
+// redactedError is an error whose message has been redacted
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e redactedError) Error() string {
+	return e.msg
+}
+
+// redactError returns the error with credentials scrubbed from its message.
+// Errors of the fetcherrors types keep their type with their messages and
+// internal errors redacted; errors with nothing to redact are returned as
+// they are so they can still be compared with, like context.Canceled.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch e := err.(type) {
+	case fetcherrors.PkgMetaError:
+		return fetcherrors.PkgMetaError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgPrecheckError:
+		return fetcherrors.PkgPrecheckError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgSourceFetchAuthError:
+		return fetcherrors.PkgSourceFetchAuthError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgSourceFetchError:
+		return fetcherrors.PkgSourceFetchError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgSourceError:
+		return fetcherrors.PkgSourceError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgSignatureVerificationError:
+		return fetcherrors.PkgSignatureVerificationError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgFetchCanceledError:
+		return fetcherrors.PkgFetchCanceledError{Redact(e.Msg), redactError(e.InternalError)}
+	case fetcherrors.PkgInsufficientSpaceError:
+		return fetcherrors.PkgInsufficientSpaceError{Redact(e.Msg), e.RequiredBytes, e.AvailableBytes, redactError(e.InternalError)}
+	case fetcherrors.PkgLockTimeoutError:
+		return fetcherrors.PkgLockTimeoutError{Redact(e.Msg), redactError(e.InternalError)}
+	}
+
+	msg := err.Error()
+	if redacted := Redact(msg); redacted != msg {
+		return redactedError{redacted, err}
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package fetch
+
+import (
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"time"
+)
+
+// FetchResult describes a successfully fetched Pkg
+type FetchResult struct {
+	Pkg          *horizonpkg.Pkg
+	MetaFilePath string                // the absolute path of the verified Pkg meta file
+	Parts        map[string]PartResult // keyed by docker image repotag
+	FromManifest bool                  // true if the fetch was satisfied by the manifest of a previous fetch
+}
+
+// ImagePaths returns a mapping of docker image repotag to the absolute path
+// of the part providing the image. A skipped part's path is the empty string.
+func (r *FetchResult) ImagePaths() map[string]string {
+	paths := make(map[string]string, 0)
+	for repotag, part := range r.Parts {
+		paths[repotag] = part.Path
+	}
+
+	return paths
+}
+
+// PartResult describes a fetched part of a Pkg
+type PartResult struct {
+	Repotag    string
+	PartID     string
+	Path       string // the absolute path of the part; empty if its fetch was skipped
+	Bytes      int64
+	Sha256sum  string
+	SourceURL  string // the source the part was downloaded from (the first of them if it was downloaded in chunks); empty if it was already on disk
+	Skipped    bool
+	Cached     bool           // true if the part was linked from the part cache rather than downloaded
+	Duration   time.Duration  // the time spent fetching and verifying the part, including retries
+	Attempts   []FetchAttempt // every attempt to download the part from a source
+	VerifiedAt time.Time
+	VerifiedBy []string // the key files that verified the part's signatures
+}
+
+// partFetch carries the state of the fetch of a single part across attempts
+type partFetch struct {
+	attempt   int // the attempt at fetching the whole part, starting at 1
+	progress  *partProgress
+	attempts  []FetchAttempt
+	sourceURL string
+}
+
+// record keeps the attempt and hands it to the options' observer
+func (f *partFetch) record(options *Options, attempt FetchAttempt) {
+	// the error of a failed attempt may carry the credentials of its URL
+	attempt.Err = redactError(attempt.Err)
+	f.attempts = append(f.attempts, attempt)
+	options.recordAttempt(attempt)
+}
+
+func (r PartResult) manifestPart() ManifestPart {
+	return ManifestPart{
+		PartID:     r.PartID,
+		Path:       r.Path,
+		Bytes:      r.Bytes,
+		Sha256sum:  r.Sha256sum,
+		Skipped:    r.Skipped,
+		VerifiedAt: r.VerifiedAt,
+		VerifiedBy: r.VerifiedBy,
+	}
+}
+
+func (m ManifestPart) partResult(repotag string) PartResult {
+	return PartResult{
+		Repotag:    repotag,
+		PartID:     m.PartID,
+		Path:       m.Path,
+		Bytes:      m.Bytes,
+		Sha256sum:  m.Sha256sum,
+		Skipped:    m.Skipped,
+		VerifiedAt: m.VerifiedAt,
+		VerifiedBy: m.VerifiedBy,
+	}
+}
@@ -0,0 +1,166 @@
+package fetch
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
+// RetryPolicy configures retries of part downloads. Retries are applied per
+// source (a failed download is retried from the same source up to
+// MaxAttempts times before the next source is tried) and per part (if all
+// sources fail, the last of them retryably, or the downloaded content fails
+// its hash check, the whole part is fetched again up to MaxPartAttempts
+// times).
+type RetryPolicy struct {
+	MaxAttempts     int           // attempts per source; values less than 1 mean 1
+	MaxPartAttempts int           // attempts per part, across all sources; values less than 1 mean 1
+	BaseBackoff     time.Duration // the delay before the first retry; it doubles with every subsequent retry
+	MaxBackoff      time.Duration // the upper bound on delay between retries; zero means none
+	Jitter          float64       // the fraction (0.0 to 1.0) of each delay that is randomized
+
+	// RetryableStatusCodes lists the HTTP response status codes that warrant
+	// a retry
+	RetryableStatusCodes []int
+
+	// RetryableError decides if a network or transfer error warrants a retry;
+	// if nil, all such errors are retried except for TLS certificate errors
+	RetryableError func(err error) bool
+}
+
+// DefaultRetryPolicy returns the policy used when none is configured. It
+// retries timeouts, throttling and server errors but not authentication or
+// authorization errors (401, 403).
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:     3,
+		MaxPartAttempts: 2,
+		BaseBackoff:     time.Second,
+		MaxBackoff:      30 * time.Second,
+		Jitter:          0.2,
+		RetryableStatusCodes: []int{
+			408, // request timeout
+			429, // too many requests
+			500, // internal server error
+			502, // bad gateway
+			503, // service unavailable
+			504, // gateway timeout
+		},
+	}
+}
+
+// FetchAttempt is a record of a single attempt to download a part from one
+// of its sources.
+type FetchAttempt struct {
+	PartID         string
+	URL            string
+	Range          string // the byte range requested if the part was downloaded in chunks
+	PartAttempt    int    // the attempt at fetching the whole part, starting at 1
+	SourceAttempt  int    // the attempt at fetching from this URL during this part attempt, starting at 1
+	StartedAt      time.Time
+	Duration       time.Duration
+	HTTPStatusCode int           // 0 if no response was received
+	Err            error         // nil if the attempt succeeded
+	Backoff        time.Duration // the delay before the next attempt, if a retry follows
+}
+
+// String provides a loggable summary of the attempt
+func (a FetchAttempt) String() string {
+	from := a.URL
+	if a.Range != "" {
+		from = fmt.Sprintf("%v (%v)", a.URL, a.Range)
+	}
+	return Redact(fmt.Sprintf("part %v attempt %v from %v (try %v): status %v after %v, error: %v, backoff: %v", a.PartID, a.PartAttempt, from, a.SourceAttempt, a.HTTPStatusCode, a.Duration, a.Err, a.Backoff))
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) maxPartAttempts() int {
+	if p.MaxPartAttempts < 1 {
+		return 1
+	}
+	return p.MaxPartAttempts
+}
+
+// retryable decides if a failed download from a source should be retried
+func (p *RetryPolicy) retryable(failure *partFetchFailure) bool {
+	if failure.Err != nil {
+		if p.RetryableError != nil {
+			return p.RetryableError(failure.Err)
+		}
+		return defaultRetryableError(failure.Err)
+	}
+
+	for _, code := range p.RetryableStatusCodes {
+		if code == failure.HTTPStatusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func defaultRetryableError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return false
+	}
+
+	return true
+}
+
+// Backoff returns the delay before the given retry (the first retry is 1).
+// It's exported for callers retrying whole fetches, like the fetchqueue
+// package, by the same policy.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	delay := p.BaseBackoff
+	for ix := 1; ix < retry && delay > 0; ix++ {
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+
+		// without a bound, doubling stops short of overflowing
+		if delay > math.MaxInt64/2 {
+			delay = math.MaxInt64
+			break
+		}
+		delay *= 2
+	}
+
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// sleep waits for the given duration or until the context is done, returning
+// false in the latter case
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
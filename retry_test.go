@@ -0,0 +1,39 @@
+// +build unit
+
+package fetch
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_RetryPolicy_Suite(suite *testing.T) {
+
+	suite.Run("Backoff doubles up to MaxBackoff", func(t *testing.T) {
+		policy := &RetryPolicy{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+		var delays []time.Duration
+		for retry := 1; retry <= 5; retry++ {
+			delays = append(delays, policy.Backoff(retry))
+		}
+		assert.EqualValues(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+	})
+
+	suite.Run("Backoff doubles without bound when MaxBackoff is zero", func(t *testing.T) {
+		policy := &RetryPolicy{BaseBackoff: time.Second}
+
+		var delays []time.Duration
+		for retry := 1; retry <= 4; retry++ {
+			delays = append(delays, policy.Backoff(retry))
+		}
+		assert.EqualValues(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, delays)
+
+		assert.EqualValues(t, time.Duration(math.MaxInt64), policy.Backoff(100))
+	})
+
+	suite.Run("Backoff is zero without BaseBackoff", func(t *testing.T) {
+		assert.Zero(t, (&RetryPolicy{MaxBackoff: time.Second}).Backoff(3))
+	})
+}
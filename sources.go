@@ -0,0 +1,98 @@
+package fetch
+
+import (
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// fileScheme is the scheme of source URLs naming files on a local or mounted
+// file system
+const fileScheme = "file"
+
+// sourceTransport serves file:// URLs from the local file system and hands
+// every other request to the transport of the client it was made for
+type sourceTransport struct {
+	base  http.RoundTripper
+	files http.RoundTripper
+}
+
+func (t *sourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == fileScheme {
+		glog.V(5).Infof("Serving %v from the file system", Redact(req.URL.String()))
+		return t.files.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// withFileSources wraps the client factory so that the clients it returns
+// can fetch file:// URLs as well as whatever the factory's clients support.
+// Files are served with range support so partial downloads of them resume
+// like any other. Clients fetching from a bundle are left as they are: the
+// bundle serves file:// sources too, from its own content rather than the
+// host's file system.
+func withFileSources(httpClientFactory func(overrideTimeoutS *uint) *http.Client) func(overrideTimeoutS *uint) *http.Client {
+	files := http.NewFileTransport(http.Dir("/"))
+
+	return func(overrideTimeoutS *uint) *http.Client {
+		client := httpClientFactory(overrideTimeoutS)
+
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		} else if _, bundled := base.(*bundleTransport); bundled {
+			return client
+		}
+
+		wrapped := *client
+		wrapped.Transport = &sourceTransport{base: base, files: files}
+		return &wrapped
+	}
+}
+
+// resolveSourceURL returns the URL from which to download a part given the
+// URL of one of its sources as recorded in the Pkg. Absolute URLs are used as
+// they are. A path starting with a single "/" is by convention relative to
+// the Pkg URL's directory rather than its host's root; any other relative
+// reference, like "parts/a.tgz", "../a.tgz" or "//host/a.tgz", is resolved
+// against the Pkg URL per RFC 3986 so a Pkg can be served along with its
+// parts from any directory layout, file:// URLs included.
+func resolveSourceURL(pkgURL *url.URL, sourceURL string) (string, error) {
+	reference := sourceURL
+	if strings.HasPrefix(sourceURL, "/") && !strings.HasPrefix(sourceURL, "//") {
+		// it's an absolute path but by convention it's relative to the Pkg's directory rather than its host's root
+		reference = "." + sourceURL
+	}
+
+	ref, err := url.Parse(reference)
+	if err != nil {
+		return "", err
+	}
+
+	if ref.IsAbs() {
+		return sourceURL, nil
+	}
+
+	// the Pkg URL's query and fragment, like the signature of a pre-signed
+	// link, belong to it alone and aren't carried over
+	pURL := pkgURL.ResolveReference(ref).String()
+	glog.V(3).Infof("Part has relative URL %v, resolved it against Pkg URL to %v", Redact(sourceURL), Redact(pURL))
+	return pURL, nil
+}
+
+// resolveSourceURLs resolves the URLs of all of a part's sources per
+// resolveSourceURL, passing over any that can't be parsed
+func resolveSourceURLs(pkgURL *url.URL, sources []horizonpkg.PartSource) []string {
+	var urls []string
+	for _, source := range sources {
+		pURL, err := resolveSourceURL(pkgURL, source.URL)
+		if err != nil {
+			glog.Errorf("Ignoring part source with invalid URL %v. Error: %v", Redact(source.URL), redactError(err))
+			continue
+		}
+		urls = append(urls, pURL)
+	}
+	return urls
+}
@@ -0,0 +1,137 @@
+package fetch
+
+import (
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// tempPartPrefix and tempPartSuffix surround a part's ID to name the file
+	// it is downloaded to before it is verified and renamed into place
+	tempPartPrefix = "."
+	tempPartSuffix = ".partial"
+)
+
+// tempPartPath returns the path of the temporary file a part is downloaded to
+func tempPartPath(partPath string) string {
+	return path.Join(path.Dir(partPath), tempPartPrefix+path.Base(partPath)+tempPartSuffix)
+}
+
+// tempPartID returns the ID of the part a temporary part file name belongs
+// to or the empty string if the name isn't one of a temporary part file
+func tempPartID(name string) string {
+	if !strings.HasPrefix(name, tempPartPrefix) || !strings.HasSuffix(name, tempPartSuffix) || len(name) <= len(tempPartPrefix)+len(tempPartSuffix) {
+		return ""
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(name, tempPartPrefix), tempPartSuffix)
+}
+
+// commitPart atomically moves a verified part from its temporary file into
+// place and makes sure the rename is durable
+func commitPart(tempPath string, partPath string) error {
+	if err := os.Rename(tempPath, partPath); err != nil {
+		return err
+	}
+
+	removeResumeState(tempPath)
+
+	dir, err := os.Open(path.Dir(partPath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	// not every platform supports syncing directories; the rename is done regardless
+	if err := dir.Sync(); err != nil {
+		glog.V(5).Infof("Unable to sync directory %v after renaming part into it. Error: %v", path.Dir(partPath), err)
+	}
+
+	return nil
+}
+
+// writeFileAtomically writes the content to a temporary file beside the
+// given path and renames it into place, so readers of the file see its old
+// content or the new but never part of either. Concurrent writers don't share
+// temporary files.
+func writeFileAtomically(filePath string, content []byte) error {
+	temp, err := ioutil.TempFile(path.Dir(filePath), tempPartPrefix+path.Base(filePath)+".*"+tempPartSuffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// sweepStaleTempParts removes temporary part files in pkgDir that can't be
+// used by the fetch of the given parts: those of parts not in the Pkg and
+// those that can't be resumed. Resume state without a temporary part file is
+// removed too. Files of parts locked by another fetch are left alone.
+func sweepStaleTempParts(pkgDir string, partIDs map[string]bool) {
+	infos, err := ioutil.ReadDir(pkgDir)
+	if err != nil {
+		glog.Errorf("Unable to list Pkg directory %v to sweep stale temporary part files. Error: %v", pkgDir, err)
+		return
+	}
+
+	remove := func(name string) {
+		glog.V(3).Infof("Removing stale temporary file %v from Pkg directory %v", name, pkgDir)
+		if err := os.Remove(path.Join(pkgDir, name)); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Failed to remove stale temporary file %v. Error: %v", path.Join(pkgDir, name), err)
+		}
+	}
+
+	names := make(map[string]bool, 0)
+	for _, info := range infos {
+		names[info.Name()] = true
+	}
+
+	// removes the files only if no other fetch is working on the part
+	removeUnlocked := func(partID string, names ...string) {
+		lock, err := tryLock(lockPath(pkgDir, partID), true)
+		if err != nil {
+			glog.V(5).Infof("Not removing temporary files %v of part %v. Error: %v", names, partID, err)
+			return
+		}
+		defer lock.release()
+
+		for _, name := range names {
+			remove(name)
+		}
+	}
+
+	for name := range names {
+		if strings.HasSuffix(name, resumeSuffix) {
+			if partID := tempPartID(strings.TrimSuffix(name, resumeSuffix)); partID != "" && !names[strings.TrimSuffix(name, resumeSuffix)] {
+				removeUnlocked(partID, name)
+			}
+			continue
+		}
+
+		partID := tempPartID(name)
+		if partID == "" {
+			continue
+		}
+
+		if !partIDs[partID] || !names[name+resumeSuffix] {
+			if names[name+resumeSuffix] {
+				removeUnlocked(partID, name, name+resumeSuffix)
+			} else {
+				removeUnlocked(partID, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// validatorsSuffix is appended to a Pkg's ID to name the file holding the
+// validators of its meta file in the destination directory
+const validatorsSuffix = ".json.validators"
+
+// metaValidators are the validators of the response that delivered a Pkg's
+// meta file. They're sent with the next request of the same URL so that a
+// meta file that hasn't changed isn't downloaded again.
+type metaValidators struct {
+	// URL is the redacted URL of the meta file, so that validators outlive
+	// rotating signatures of pre-signed links without keeping them on disk
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	pkgID string
+}
+
+func validatorsPath(destinationDir string, pkgID string) string {
+	return path.Join(destinationDir, pkgID+validatorsSuffix)
+}
+
+// validatorsURL returns the URL of the meta file whose validators are
+// recorded
+func validatorsURL(raw []byte) (string, error) {
+	var validators metaValidators
+	if err := json.Unmarshal(raw, &validators); err != nil {
+		return "", err
+	}
+	return validators.URL, nil
+}
+
+// readMetaValidators returns the validators stored by a previous fetch of the
+// meta file at the given URL into destinationDir, or nil if there are none
+// usable. They're found by the URL they record, whatever the ID of the Pkg
+// they're stored with. The meta file must still be there to be used in place
+// of a new copy.
+func readMetaValidators(destinationDir string, pkgURL string) *metaValidators {
+	for _, pkgID := range pkgIDsByURL(destinationDir, pkgURL, validatorsSuffix, validatorsURL) {
+		raw, err := ioutil.ReadFile(validatorsPath(destinationDir, pkgID))
+		if err != nil {
+			continue
+		}
+
+		var validators metaValidators
+		if err := json.Unmarshal(raw, &validators); err != nil {
+			glog.Errorf("Ignoring unusable validators of Pkg meta %v. Error: %v", pkgID, err)
+			continue
+		}
+
+		if validators.URL != Redact(pkgURL) || (validators.ETag == "" && validators.LastModified == "") {
+			continue
+		}
+
+		if _, err := os.Stat(pkgMetaPath(destinationDir, pkgID)); err != nil {
+			continue
+		}
+
+		validators.pkgID = pkgID
+		return &validators
+	}
+
+	return nil
+}
+
+// apply makes the request conditional on the meta file having changed; it's
+// safe to call on nil
+func (v *metaValidators) apply(req *http.Request) {
+	if v == nil {
+		return
+	}
+
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// newMetaValidators returns the validators of the response that delivered
+// the Pkg meta file from the given URL. Only HTTP servers' validators are
+// kept; files and bundles are read locally anyway.
+func newMetaValidators(pkgURL string, header http.Header) *metaValidators {
+	validators := &metaValidators{URL: Redact(pkgURL)}
+	if parsed, err := url.Parse(pkgURL); err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") {
+		validators.ETag = header.Get("ETag")
+		validators.LastModified = header.Get("Last-Modified")
+	}
+	return validators
+}
+
+// empty reports if there's nothing to make a request conditional on
+func (v *metaValidators) empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// stored reports if the validators are those stored for the Pkg, or if
+// there are none stored when they're empty
+func (v *metaValidators) stored(destinationDir string, pkgID string) bool {
+	raw, err := ioutil.ReadFile(validatorsPath(destinationDir, pkgID))
+	if os.IsNotExist(err) {
+		return v.empty()
+	} else if err != nil {
+		return false
+	}
+
+	var stored metaValidators
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return false
+	}
+	return stored.URL == v.URL && stored.ETag == v.ETag && stored.LastModified == v.LastModified
+}
+
+// writeMetaValidators stores the validators of the Pkg's meta file from the
+// given URL, or removes those of an earlier response if they're empty
+func writeMetaValidators(destinationDir string, pkgID string, pkgURL string, validators *metaValidators) {
+	// those of a Pkg previously published at the URL no longer apply to it
+	for _, previous := range pkgIDsByURL(destinationDir, pkgURL, validatorsSuffix, validatorsURL) {
+		if previous == pkgID {
+			continue
+		}
+		if raw, err := ioutil.ReadFile(validatorsPath(destinationDir, previous)); err == nil {
+			if recorded, err := validatorsURL(raw); err == nil && recorded == validators.URL {
+				if err := os.Remove(validatorsPath(destinationDir, previous)); err != nil && !os.IsNotExist(err) {
+					glog.Errorf("Failed to remove validators of Pkg meta %v. Error: %v", previous, err)
+				}
+			}
+		}
+	}
+
+	vPath := validatorsPath(destinationDir, pkgID)
+	if validators.empty() {
+		if err := os.Remove(vPath); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Failed to remove validators of Pkg meta %v. Error: %v", pkgID, err)
+		}
+		return
+	}
+
+	raw, err := json.Marshal(validators)
+	if err == nil {
+		err = writeFileAtomically(vPath, raw)
+	}
+	if err != nil {
+		glog.Errorf("Failed to write validators of Pkg meta %v, it will be fetched in full next time. Error: %v", pkgID, err)
+	}
+}
+
+// pkgMeta is a verified Pkg meta file as fetched, along with the validators
+// of the response that delivered it
+type pkgMeta struct {
+	pkgURL     string
+	raw        []byte
+	validators *metaValidators // nil if the local copy was used, leaving those stored as they are
+}
+
+func pkgMetaPath(destinationDir string, pkgID string) string {
+	return path.Join(destinationDir, fmt.Sprintf("%v.json", pkgID))
+}
+
+// stored reports if the meta file and its validators are stored as fetched
+func (m *pkgMeta) stored(destinationDir string, pkgID string) bool {
+	raw, err := ioutil.ReadFile(pkgMetaPath(destinationDir, pkgID))
+	if err != nil || !bytes.Equal(raw, m.raw) {
+		return false
+	}
+	return m.validators == nil || m.validators.stored(destinationDir, pkgID)
+}
+
+// write stores the meta file and its validators; the files are replaced
+// atomically so that readers never see them half written
+func (m *pkgMeta) write(destinationDir string, pkgID string) error {
+	metaPath := pkgMetaPath(destinationDir, pkgID)
+	if err := writeFileAtomically(metaPath, m.raw); err != nil {
+		return fetcherrors.PkgMetaError{fmt.Sprintf("Failed to write file %v", metaPath), err}
+	}
+	glog.V(2).Infof("Wrote PkgMeta to %v", metaPath)
+
+	if m.validators != nil {
+		writeMetaValidators(destinationDir, pkgID, m.pkgURL, m.validators)
+	}
+	return nil
+}
+
+// lockPkgMeta takes the lock of the Pkg, shared, once its meta file and the
+// validators are stored as fetched. They're written, if they aren't already,
+// with the lock held exclusively so that neither a concurrent fetch reading
+// them nor a removal of the Pkg gets in the way. A removal between the write
+// and taking the lock shared has them written again.
+func lockPkgMeta(ctx context.Context, destinationDir string, pkgID string, meta *pkgMeta, timeout time.Duration) (*fileLock, error) {
+	lp := lockPath(destinationDir, pkgID)
+	for {
+		lock, err := acquireLock(ctx, lp, false, timeout)
+		if err != nil {
+			return nil, err
+		} else if meta.stored(destinationDir, pkgID) {
+			return lock, nil
+		}
+		lock.release()
+
+		lock, err = acquireLock(ctx, lp, true, timeout)
+		if err != nil {
+			return nil, err
+		}
+		err = meta.write(destinationDir, pkgID)
+		lock.release()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLocalPkgMeta reads the meta file of the Pkg with the given ID from
+// destinationDir and verifies it against the given signature, returning the
+// Pkg and the file's content
+func readLocalPkgMeta(destinationDir string, pkgID string, pkgURLSignature string, keyFiles []string) (*horizonpkg.Pkg, []byte, error) {
+	rawMeta, err := ioutil.ReadFile(pkgMetaPath(destinationDir, pkgID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkg, err := verifyPkgMeta(rawMeta, pkgURLSignature, keyFiles)
+	if err != nil {
+		return nil, nil, err
+	} else if pkg.ID != pkgID {
+		return nil, nil, fmt.Errorf("Pkg ID mismatch between validators (%v) and meta file (%v)", pkgID, pkg.ID)
+	}
+
+	return pkg, rawMeta, nil
+}
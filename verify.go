@@ -0,0 +1,176 @@
+package fetch
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadPublicKeys reads the RSA public keys in the given PEM files. Files that
+// can't be read or parsed are reported in the returned map, keyed by file
+// name; they don't prevent other keys from being loaded.
+func loadPublicKeys(keyFiles []string) (map[string]*rsa.PublicKey, map[string]error) {
+	keys := make(map[string]*rsa.PublicKey, 0)
+	failed := make(map[string]error, 0)
+
+	for _, keyFile := range keyFiles {
+		key, err := loadPublicKey(keyFile)
+		if err != nil {
+			failed[keyFile] = err
+		} else {
+			keys[keyFile] = key
+		}
+	}
+
+	return keys, failed
+}
+
+func loadPublicKey(keyFile string) (*rsa.PublicKey, error) {
+	raw, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("No PEM-encoded content found")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported public key type: %T", key)
+	}
+
+	return rsaKey, nil
+}
+
+// verifyDigestWithAnyKey checks a base64-encoded RSA PSS signature of a
+// SHA-256 digest against each of the given keys. It returns the name of the
+// file of the first key that verifies the signature or an error describing
+// the failure with each key.
+func verifyDigestWithAnyKey(keys map[string]*rsa.PublicKey, digest []byte, signature string) (string, error) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode signature: %v", err)
+	}
+
+	failed := make(map[string]error, 0)
+	for keyFile, key := range keys {
+		if err := rsa.VerifyPSS(key, crypto.SHA256, digest, sig, nil); err != nil {
+			failed[keyFile] = err
+		} else {
+			return keyFile, nil
+		}
+	}
+
+	return "", fmt.Errorf("No key verified signature. Failures: %v", failed)
+}
+
+// TrustMode is a faux-enum identifying how the signatures of a part must be
+// verified for the part to be trusted
+type TrustMode string
+
+const (
+	// TrustAllSignatures requires that every signature of a part is verified
+	// by one of the configured keys. This is the default.
+	TrustAllSignatures TrustMode = "ALL"
+
+	// TrustAnySignature requires that at least one signature of a part is
+	// verified by one of the configured keys
+	TrustAnySignature TrustMode = "ANY"
+
+	// TrustThreshold requires that signatures of a part are verified by at
+	// least TrustPolicy.Threshold distinct configured keys. This allows
+	// publishers to co-sign parts.
+	TrustThreshold TrustMode = "THRESHOLD"
+)
+
+// TrustPolicy configures the verification of part signatures. The Pkg meta
+// file has a single signature so it's always verified as if with
+// TrustAllSignatures.
+type TrustPolicy struct {
+	Mode      TrustMode
+	Threshold int // the number of distinct keys required by TrustThreshold (M of N)
+}
+
+// DefaultTrustPolicy returns the policy used when none is configured
+func DefaultTrustPolicy() *TrustPolicy {
+	return &TrustPolicy{Mode: TrustAllSignatures}
+}
+
+// keyIdentity identifies a key by its material rather than the file it was
+// read from so that copies of a key aren't counted as distinct keys
+func keyIdentity(key *rsa.PublicKey) string {
+	return fmt.Sprintf("%x:%x", key.N, key.E)
+}
+
+// verifySignatures checks the given signatures of content with the given
+// SHA-256 digest against the keys in keyFiles per the trust policy. It returns
+// the names of the key files that verified signatures.
+func verifySignatures(keyFiles []string, digest []byte, signatures []string, policy *TrustPolicy) ([]string, error) {
+	if len(signatures) == 0 {
+		return nil, VerificationError{"No signatures to verify"}
+	}
+
+	keys, failedKeys := loadPublicKeys(keyFiles)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No usable keys in key files: %v. Failures: %v", keyFiles, failedKeys)
+	}
+
+	var verifiedBy []string
+	distinct := make(map[string]bool, 0)
+	failures := make(map[string]error, 0)
+
+	// this is computationally expensive
+	for _, sig := range signatures {
+		// TODO: perhaps we should give keys IDs and include those in the pkg signature
+		keyFile, err := verifyDigestWithAnyKey(keys, digest, sig)
+		if err != nil {
+			failures[sig] = err
+			continue
+		}
+
+		id := keyIdentity(keys[keyFile])
+		if !distinct[id] {
+			distinct[id] = true
+			verifiedBy = append(verifiedBy, keyFile)
+		}
+	}
+
+	switch policy.Mode {
+	case TrustAnySignature:
+		if len(verifiedBy) == 0 {
+			return nil, fmt.Errorf("No signature of content with digest: %x verified. Errors: %v", digest, failures)
+		}
+
+	case TrustThreshold:
+		if policy.Threshold < 1 {
+			return nil, fmt.Errorf("Illegal trust policy threshold: %v", policy.Threshold)
+		}
+
+		if len(distinct) < policy.Threshold {
+			return nil, fmt.Errorf("Signatures of content with digest: %x verified by %v distinct keys, %v required. Errors: %v", digest, len(distinct), policy.Threshold, failures)
+		}
+
+	default:
+		if len(failures) != 0 {
+			return nil, fmt.Errorf("Error verifying %v of %v signatures of content with digest: %x. Errors: %v", len(failures), len(signatures), digest, failures)
+		}
+	}
+
+	return verifiedBy, nil
+}
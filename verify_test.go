@@ -0,0 +1,93 @@
+// +build unit
+
+package fetch
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_VerifySignatures_Suite(suite *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fetch-test-verify-")
+	assert.Nil(suite, err)
+	defer os.RemoveAll(tmpDir)
+
+	digest := sha256.Sum256([]byte("some part content"))
+
+	var keyFiles []string
+	var sigs []string
+	for ix := 0; ix < 3; ix++ {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.Nil(suite, err)
+
+		pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		assert.Nil(suite, err)
+
+		keyFile := path.Join(tmpDir, fmt.Sprintf("key-%v.pem", ix))
+		assert.Nil(suite, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600))
+		keyFiles = append(keyFiles, keyFile)
+
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		assert.Nil(suite, err)
+		sigs = append(sigs, base64.StdEncoding.EncodeToString(sig))
+	}
+
+	// a copy of the first key under another name
+	raw, err := ioutil.ReadFile(keyFiles[0])
+	assert.Nil(suite, err)
+	copyFile := path.Join(tmpDir, "key-copy.pem")
+	assert.Nil(suite, ioutil.WriteFile(copyFile, raw, 0600))
+
+	badSig := base64.StdEncoding.EncodeToString([]byte("not a signature"))
+
+	suite.Run("All signatures must verify by default", func(t *testing.T) {
+		verifiedBy, err := verifySignatures(keyFiles, digest[:], sigs, DefaultTrustPolicy())
+		assert.Nil(t, err)
+		assert.EqualValues(t, 3, len(verifiedBy))
+
+		_, err = verifySignatures(keyFiles, digest[:], []string{sigs[0], badSig}, DefaultTrustPolicy())
+		assert.NotNil(t, err)
+
+		_, err = verifySignatures(keyFiles[1:], digest[:], sigs, DefaultTrustPolicy())
+		assert.NotNil(t, err)
+
+		_, err = verifySignatures(keyFiles, digest[:], []string{}, DefaultTrustPolicy())
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("Any signature suffices with TrustAnySignature", func(t *testing.T) {
+		policy := &TrustPolicy{Mode: TrustAnySignature}
+
+		verifiedBy, err := verifySignatures(keyFiles, digest[:], []string{badSig, sigs[1]}, policy)
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{keyFiles[1]}, verifiedBy)
+
+		_, err = verifySignatures(keyFiles, digest[:], []string{badSig}, policy)
+		assert.NotNil(t, err)
+	})
+
+	suite.Run("TrustThreshold counts distinct keys", func(t *testing.T) {
+		policy := &TrustPolicy{Mode: TrustThreshold, Threshold: 2}
+
+		_, err := verifySignatures(keyFiles, digest[:], []string{sigs[0], sigs[2], badSig}, policy)
+		assert.Nil(t, err)
+
+		// the same signature twice and a copy of the key it verifies with don't make two keys
+		_, err = verifySignatures([]string{keyFiles[0], copyFile}, digest[:], []string{sigs[0], sigs[0]}, policy)
+		assert.NotNil(t, err)
+
+		_, err = verifySignatures(keyFiles, digest[:], sigs, &TrustPolicy{Mode: TrustThreshold})
+		assert.NotNil(t, err)
+	})
+}